@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const MAX_ALTERNATIVES = 9
+
+type LLMAlternative struct {
+	Command       string `json:"command"`
+	Commentary    string `json:"commentary"`
+	Risk          string `json:"risk"`
+	ModifiesFiles bool   `json:"modifies_files"`
+}
+
+// Choices is a ranked list of suggestions for one request, waiting for the
+// user to pick one.
+type Choices struct {
+	request LLMRequest
+	options []LLMResponse
+}
+
+// alternativesRule tells the model how many alternatives we want.
+func alternativesRule(n int, exclude []string) string {
+	if n <= 1 {
+		return ""
+	}
+
+	rule := fmt.Sprintf(
+		"Besides the best command, give %d other ranked alternatives in \"alternatives\", best first, each with its own commentary and risk.",
+		n-1)
+
+	if len(exclude) > 0 {
+		rule += "\nThe user has already seen these commands, suggest different ones:\n" +
+			strings.Join(exclude, "\n")
+	}
+
+	return rule
+}
+
+func riskColor(risk string) string {
+	switch strings.ToLower(risk) {
+	case "low":
+		return "\x1b[32m"
+	case "high":
+		return "\x1b[31m"
+	default:
+		return "\x1b[33m"
+	}
+}
+
+func (c *Choices) describe() string {
+	var out strings.Builder
+
+	for i, option := range c.options {
+		risk := sanitizeTerminalText(option.risk, option.sanitize)
+		if risk == "" {
+			risk = "unknown"
+		}
+
+		fmt.Fprintf(&out, "\x1b[34m%d. %s\x1b[0m %s[risk: %s]\x1b[0m\r\n   %s\r\n",
+			i+1,
+			sanitizeTerminalText(option.command, option.sanitize),
+			riskColor(option.risk), risk,
+			strings.ReplaceAll(adjustNewlines(sanitizeTerminalText(option.commentary, option.sanitize)), "\r\n", "\r\n   "))
+
+		if option.source != "" {
+			fmt.Fprintf(&out, "   \x1b[35mSource: %s\r\n\x1b[0m", option.source)
+		}
+
+		for _, warning := range option.warnings {
+			fmt.Fprintf(&out, "   \x1b[33mWarning: %s\r\n\x1b[0m", sanitizeTerminalText(warning, option.sanitize))
+		}
+	}
+
+	out.WriteString("\x1b[33mPick with <number>, edit in the shell with e<number>, m for more alternatives, or type a new request\r\n\x1b[0m")
+
+	return out.String()
+}
+
+func (c *Choices) commands() []string {
+	var commands []string
+
+	for _, option := range c.options {
+		commands = append(commands, option.command)
+	}
+
+	return commands
+}
+
+// handleChoice handles a line typed while alternatives are shown. It returns
+// false when the line isn't a picker action, i.e. it's a new request.
+func (l *LLMWrapper) handleChoice(line string) bool {
+	choices := l.choices
+
+	if line == "m" || line == "more" {
+		request := choices.request
+		request.exclude = choices.commands()
+		request.shellHistory = l.shellHistory.String()
+		request.llmHistory = l.llmHistory.String()
+
+		response, ok := l.suggest(request)
+		if !ok {
+			return true
+		}
+
+		added := 0
+
+		// offline suggestions don't know about exclude
+		for _, option := range append([]LLMResponse{response}, response.alternatives...) {
+			if strings.TrimSpace(option.command) != "" && !slices.Contains(choices.commands(), option.command) {
+				option.alternatives = nil
+				choices.options = append(choices.options, l.stampResponse(option))
+				added++
+			}
+		}
+
+		if added == 0 {
+			l.outputToTerminal("No other suggestions\r\n")
+			return true
+		}
+
+		l.outputChannel <- "\r" + choices.describe()
+		return true
+	}
+
+	edit := strings.HasPrefix(line, "e")
+	if edit {
+		line = strings.TrimSpace(line[1:])
+	}
+
+	n, err := strconv.Atoi(line)
+	if err != nil {
+		return false
+	}
+
+	if n < 1 || n > len(choices.options) {
+		l.outputToTerminal(fmt.Sprintf("Pick a number between 1 and %d\r\n", len(choices.options)))
+		return true
+	}
+
+	response := choices.options[n-1]
+	response.alternatives = nil
+
+	// editing happens in the shell: the command is typed but not run
+	response.review = response.review || edit
+
+	l.choices = nil
+	l.deliverResponse(response)
+
+	return true
+}
+
+// stampResponse fills in the display settings of a response we show, but
+// don't deliver yet.
+func (l *LLMWrapper) stampResponse(response LLMResponse) LLMResponse {
+	response.sanitize = l.settings.sanitize
+	return response
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// how many checkpoints /undo can walk back through
+	MAX_CHECKPOINTS = 20
+
+	CHECKPOINT_REF_PREFIX = "refs/layosh/checkpoints/"
+
+	// the snapshot index of a session, kept in the git directory so that
+	// the next snapshot only hashes the files that changed
+	CHECKPOINT_INDEX_PREFIX = "layosh-index-"
+
+	// a git command that takes longer, on a huge repository, fails the
+	// checkpoint or the undo
+	GIT_TIMEOUT = 30 * time.Second
+)
+
+// Checkpoint is a snapshot of a git working tree, index and HEAD, taken
+// before an LLM-suggested command is injected into the shell. The working
+// tree (tracked and untracked, non-ignored files) is stored as a commit, the
+// way git stash does, and kept alive by a ref with a reflog.
+type Checkpoint struct {
+	// top level of the working tree
+	root string
+
+	command string
+
+	// the snapshot commit, its tree is the working tree
+	commit string
+
+	// tree of the index at the time of the snapshot
+	indexTree string
+
+	// the commit HEAD pointed to, empty for an unborn branch
+	head string
+
+	// the branch HEAD pointed to, empty when detached
+	branch string
+}
+
+func runGit(dir string, env []string, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), GIT_TIMEOUT)
+	defer cancel()
+
+	c := exec.CommandContext(ctx, "git", append([]string{"-C", dir}, args...)...)
+	c.Env = append(os.Environ(), env...)
+
+	var stderr bytes.Buffer
+	c.Stderr = &stderr
+
+	out, err := c.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %v: %s",
+			strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+// withTempIndex runs f with GIT_INDEX_FILE pointing to a scratch copy of the
+// index, so the user's staging area is left alone. Starting from a copy lets
+// git reuse the cached stat data instead of hashing every file.
+func withTempIndex(root string, f func(env []string) error) error {
+	gitDir, err := runGit(root, nil, "rev-parse", "--absolute-git-dir")
+	if err != nil {
+		return err
+	}
+
+	index, err := os.CreateTemp(gitDir, CHECKPOINT_INDEX_PREFIX)
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(index.Name())
+
+	if err := copyIndex(gitDir, index); err != nil {
+		return err
+	}
+
+	return f([]string{"GIT_INDEX_FILE=" + index.Name()})
+}
+
+// withSessionIndex is withTempIndex with an index that outlives f, for the
+// snapshots of a session. After the first one it has the stat data of the
+// untracked files too, which the user's index never has.
+func withSessionIndex(root string, session uint32, f func(env []string) error) error {
+	gitDir, err := runGit(root, nil, "rev-parse", "--absolute-git-dir")
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(gitDir, fmt.Sprintf("%s%d", CHECKPOINT_INDEX_PREFIX, session))
+
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		index, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+
+		if err := copyIndex(gitDir, index); err != nil {
+			os.Remove(path)
+			return err
+		}
+	}
+
+	return f([]string{"GIT_INDEX_FILE=" + path})
+}
+
+// RemoveSessionIndex removes the snapshot index a session left in the git
+// directory of root.
+func RemoveSessionIndex(root string, session uint32) {
+	gitDir, err := runGit(root, nil, "rev-parse", "--absolute-git-dir")
+	if err != nil {
+		return
+	}
+
+	os.Remove(filepath.Join(gitDir, fmt.Sprintf("%s%d", CHECKPOINT_INDEX_PREFIX, session)))
+}
+
+// copyIndex copies the user's index to index and closes it. Without an index
+// yet, index is removed and git creates it.
+func copyIndex(gitDir string, index *os.File) error {
+	data, err := os.ReadFile(filepath.Join(gitDir, "index"))
+
+	if err == nil {
+		_, err = index.Write(data)
+	} else if os.IsNotExist(err) {
+		// fresh repository, git creates the index
+		err = os.Remove(index.Name())
+	}
+
+	index.Close()
+
+	return err
+}
+
+// snapshotTree writes the current working tree to the object database and
+// returns its tree id.
+func snapshotTree(root string, session uint32) (string, error) {
+	var tree string
+
+	err := withSessionIndex(root, session, func(env []string) error {
+		if _, err := runGit(root, env, "add", "-A", "."); err != nil {
+			return err
+		}
+
+		var err error
+		tree, err = runGit(root, env, "write-tree")
+
+		return err
+	})
+
+	return tree, err
+}
+
+// CreateCheckpoint snapshots the git working tree containing dir. It returns
+// nil without an error when dir isn't in a git working tree.
+func CreateCheckpoint(dir string, command string, session uint32) (*Checkpoint, error) {
+	root, err := runGit(dir, nil, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return nil, nil
+	}
+
+	checkpoint := &Checkpoint{
+		root:    root,
+		command: command,
+	}
+
+	checkpoint.head, _ = runGit(root, nil, "rev-parse", "-q", "--verify", "HEAD^{commit}")
+	checkpoint.branch, _ = runGit(root, nil, "symbolic-ref", "-q", "HEAD")
+
+	checkpoint.indexTree, err = runGit(root, nil, "write-tree")
+	if err != nil {
+		return nil, err
+	}
+
+	tree, err := snapshotTree(root, session)
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{"commit-tree", tree, "-m", "layosh checkpoint before: " + command}
+
+	if checkpoint.head != "" {
+		args = append(args, "-p", checkpoint.head)
+	}
+
+	// don't depend on the user having an identity configured
+	identity := []string{
+		"GIT_AUTHOR_NAME=layosh", "GIT_AUTHOR_EMAIL=layosh@localhost",
+		"GIT_COMMITTER_NAME=layosh", "GIT_COMMITTER_EMAIL=layosh@localhost",
+	}
+
+	checkpoint.commit, err = runGit(root, identity, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	ref := fmt.Sprintf("%s%d", CHECKPOINT_REF_PREFIX, session)
+
+	_, err = runGit(root, nil, "update-ref", "--create-reflog",
+		"-m", "checkpoint: "+command, ref, checkpoint.commit)
+	if err != nil {
+		return nil, err
+	}
+
+	Debug("Created checkpoint %s in %s", checkpoint.commit, root)
+
+	return checkpoint, nil
+}
+
+// Restore puts the working tree, index and HEAD back the way they were when
+// the checkpoint was taken. Files created since then are removed, unless
+// they are ignored.
+func (c *Checkpoint) Restore() error {
+	if c.branch != "" {
+		if _, err := runGit(c.root, nil, "symbolic-ref", "HEAD", c.branch); err != nil {
+			return err
+		}
+	}
+
+	if c.head != "" {
+		ref := c.branch
+		args := []string{"update-ref", "-m", "layosh undo: " + c.command}
+
+		if ref == "" {
+			ref = "HEAD"
+			args = append(args, "--no-deref")
+		}
+
+		if _, err := runGit(c.root, nil, append(args, ref, c.head)...); err != nil {
+			return err
+		}
+	} else if c.branch != "" {
+		// the branch was unborn, commits made since then go
+		if _, err := runGit(c.root, nil, "update-ref", "-d", c.branch); err != nil {
+			return err
+		}
+	}
+
+	err := withTempIndex(c.root, func(env []string) error {
+		// populate the scratch index with the current state, so read-tree
+		// knows which files it has to delete
+		if _, err := runGit(c.root, env, "add", "-A", "."); err != nil {
+			return err
+		}
+
+		_, err := runGit(c.root, env, "read-tree", "-u", "--reset", c.commit+"^{tree}")
+
+		return err
+	})
+
+	if err != nil {
+		return err
+	}
+
+	_, err = runGit(c.root, nil, "read-tree", c.indexTree)
+
+	return err
+}
+
+func (c *Checkpoint) String() string {
+	return fmt.Sprintf("%s in %s (before: %s)",
+		c.commit[:min(len(c.commit), 12)], filepath.Base(c.root), c.command)
+}
@@ -2,52 +2,165 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"net"
 	"os"
 	"os/signal"
 	"slices"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/darfire/layosh/messages"
 
+	"golang.org/x/sys/unix"
 	"golang.org/x/term"
-	"google.golang.org/protobuf/encoding/protodelim"
 )
 
+// how much of the terminal's input the client reads at a time, it's split
+// to the message size when sent
+const STDIN_BUFFER_SIZE = 4096
+
 type Client struct {
 	sessionId int
 	role      messages.Role
 	socket    net.Conn
 
+	// the pane an observer watches
+	watch messages.Role
+
+	// ask to lead the terminal size
+	leader bool
+
+	// the prefix key commands, e.g. detach
+	keys *PrefixKeys
+
 	stdin          *os.File
 	stdout         *os.File
 	maxMessageSize uint32
 
+	// negotiated with the server at registration
+	capabilities []messages.Capability
+
+	// guards the connection, replaced when we reconnect
+	mu sync.Mutex
+
+	// the last output received, to resume from after a disconnect
+	lastSequence atomic.Uint64
+
+	// set once the user quit, the connection is closed on purpose
+	closing atomic.Bool
+
 	reader *bufio.Reader
 	writer *bufio.Writer
 }
 
+// ServerError is an ErrorMessage the server sent before dropping us.
+type ServerError struct {
+	code   messages.ErrorCode
+	reason string
+}
+
+func (e ServerError) Error() string {
+	var summary string
+
+	switch e.code {
+	case messages.ErrorCode_ERROR_INVALID_REGISTRATION:
+		summary = "the server didn't understand the registration"
+	case messages.ErrorCode_ERROR_PROTOCOL_MISMATCH:
+		summary = "the client and the server are different layosh versions"
+	case messages.ErrorCode_ERROR_SESSION_MISMATCH:
+		summary = "wrong session"
+	case messages.ErrorCode_ERROR_ROLE_TAKEN:
+		summary = "the session already has a client for this role"
+	case messages.ErrorCode_ERROR_UNKNOWN_ROLE:
+		summary = "the server doesn't know this role"
+	default:
+		summary = "server error"
+	}
+
+	return fmt.Sprintf("%s: %s", summary, e.reason)
+}
+
+// SessionExit is how the wrapped command exited, the server sends it when
+// the session ends.
+type SessionExit struct {
+	code   int32
+	signal string
+}
+
+func (e SessionExit) Error() string {
+	if e.signal != "" {
+		return fmt.Sprintf("the command was killed by %s", e.signal)
+	}
+
+	return fmt.Sprintf("the command exited with code %d", e.code)
+}
+
+// Status is the exit status a shell would report for the command, 128 plus
+// the signal number when a signal killed it.
+func (e SessionExit) Status() int {
+	if e.signal != "" {
+		if signal := unix.SignalNum(e.signal); signal != 0 {
+			return 128 + int(signal)
+		}
+
+		return 1
+	}
+
+	return int(e.code)
+}
+
 func NewClient(
 	sessionId int, role messages.Role,
-	stdin *os.File, stdout *os.File) (*Client, error) {
+	stdin *os.File, stdout *os.File, options ...func(*Client)) (*Client, error) {
 	if sessionId == -1 {
 		sessionId = os.Getpid()
 	}
 
-	return &Client{
+	c := &Client{
 		sessionId: sessionId,
 		role:      role,
 		socket:    nil,
 		stdin:     stdin,
 		stdout:    stdout,
-	}, nil
+
+		keys: NewPrefixKeys(DEFAULT_PREFIX_KEY),
+	}
+
+	for _, option := range options {
+		option(c)
+	}
+
+	return c, nil
+}
+
+func WithWatch(pane messages.Role) func(*Client) {
+	return func(c *Client) {
+		c.watch = pane
+	}
 }
 
+func WithPrefixKey(prefix byte) func(*Client) {
+	return func(c *Client) {
+		c.keys = NewPrefixKeys(prefix)
+	}
+}
+
+func WithLeader(leader bool) func(*Client) {
+	return func(c *Client) {
+		c.leader = leader
+	}
+}
+
+// Register connects to the session's server. After a disconnect, it asks
+// for the output the client missed.
 func (c *Client) Register() error {
 	socketPath := fmt.Sprintf("/tmp/lash-%d/default", c.sessionId)
 
-	height, width, err := term.GetSize(int(c.stdin.Fd()))
+	width, height, err := term.GetSize(int(c.stdin.Fd()))
 	if err != nil {
 		return err
 	}
@@ -57,7 +170,7 @@ func (c *Client) Register() error {
 		return err
 	}
 
-	c.socket = conn
+	resumeAfter := c.lastSequence.Load()
 
 	registrationMessage := &messages.Message{
 		Type: messages.MessageType_REGISTRATION,
@@ -67,46 +180,283 @@ func (c *Client) Register() error {
 				Role:      c.role,
 				Width:     uint32(width),
 				Height:    uint32(height),
-			},
-		},
-	}
 
-	c.writer = bufio.NewWriter(c.socket)
-	c.reader = bufio.NewReader(c.socket)
+				ProtocolVersion: PROTOCOL_VERSION,
+				Capabilities:    supportedCapabilities,
 
-	_, err = protodelim.MarshalTo(c.writer, registrationMessage)
+				Watch:  c.watch,
+				Leader: c.leader,
 
-	if err != nil {
-		return err
+				ResumeAfter: resumeAfter,
+
+				MaxMessageSize: MAX_MESSAGE_SIZE,
+			},
+		},
 	}
 
-	err = c.writer.Flush()
-	if err != nil {
+	writer := bufio.NewWriter(conn)
+	reader := bufio.NewReader(conn)
+
+	if err := writeMessage(writer, registrationMessage); err != nil {
+		conn.Close()
 		return err
 	}
 
 	var msgIn messages.Message
 
-	err = protodelim.UnmarshalFrom(c.reader, &msgIn)
+	conn.SetReadDeadline(time.Now().Add(HEARTBEAT_TIMEOUT))
+
+	err = readMessage(reader, &msgIn, MAX_MESSAGE_SIZE)
 	if err != nil {
+		conn.Close()
 		return err
 	}
 
+	if errorMsg := msgIn.GetError(); errorMsg != nil {
+		conn.Close()
+		return ServerError{code: errorMsg.Code, reason: errorMsg.Error}
+	}
+
 	registeredMsg := msgIn.GetRegistered()
 
 	if registeredMsg == nil {
+		conn.Close()
 		return fmt.Errorf("expected REGISTERED message, got %v", msgIn.Type)
 	}
 
-	if registeredMsg.MaxMessageSize > 0 {
-		c.maxMessageSize = registeredMsg.MaxMessageSize
-	} else {
-		c.maxMessageSize = 1024
+	// the server answers with the version both sides speak, servers that
+	// predate versioning don't send one
+	if registeredMsg.ProtocolVersion < MIN_PROTOCOL_VERSION || registeredMsg.ProtocolVersion > PROTOCOL_VERSION {
+		conn.Close()
+		return fmt.Errorf("server speaks protocol version %d, this client supports %d to %d; "+
+			"restart the session after upgrading layosh",
+			registeredMsg.ProtocolVersion, MIN_PROTOCOL_VERSION, PROTOCOL_VERSION)
+	}
+
+	if resumeAfter > 0 && !registeredMsg.Resumed {
+		c.stdout.Write([]byte("\r\n\x1b[33m[layosh: reconnected, some output was lost]\x1b[0m\r\n"))
 	}
 
+	// servers that don't negotiate the size send theirs, which is no larger
+	maxMessageSize := min(registeredMsg.MaxMessageSize, MAX_MESSAGE_SIZE)
+
+	if maxMessageSize < MIN_MESSAGE_SIZE {
+		conn.Close()
+		return fmt.Errorf("the server's message size %d is below the minimum %d",
+			registeredMsg.MaxMessageSize, MIN_MESSAGE_SIZE)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.socket = conn
+	c.writer = writer
+	c.reader = reader
+
+	c.capabilities = registeredMsg.Capabilities
+	c.maxMessageSize = maxMessageSize
+
 	return nil
 }
 
+// the server is gone, it closed its socket when the session ended
+var errSessionEnded = errors.New("the session ended")
+
+// connect registers, retrying with backoff while the server can't be
+// reached, e.g. while it's starting or after a disconnect. When
+// reconnecting, a missing socket means the session ended.
+func (c *Client) connect(reconnecting bool) error {
+	deadline := time.Now().Add(RECONNECT_TIMEOUT)
+
+	for attempt := 0; ; attempt++ {
+		err := c.Register()
+
+		if err == nil {
+			return nil
+		}
+
+		if reconnecting && (errors.Is(err, syscall.ENOENT) || errors.Is(err, syscall.ECONNREFUSED)) {
+			return errSessionEnded
+		}
+
+		// the server is there and said no, retrying won't change its mind
+		var serverErr ServerError
+
+		if errors.As(err, &serverErr) || time.Now().After(deadline) {
+			return err
+		}
+
+		Debug("Error connecting to the server (attempt %d): %v\r\n", attempt+1, err)
+
+		if reconnecting && attempt == 0 {
+			c.stdout.Write([]byte("\r\n\x1b[33m[layosh: connection lost, reconnecting]\x1b[0m\r\n"))
+		}
+
+		time.Sleep(min(RECONNECT_BASE_DELAY<<attempt, RECONNECT_MAX_DELAY))
+	}
+}
+
+// send writes a message to the server, between reconnects.
+func (c *Client) send(message *messages.Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return writeMessage(c.writer, message)
+}
+
+// handleKeys sends events to the server in order, and returns false once
+// the client should stop reading its input.
+func (c *Client) handleKeys(events []KeyEvent) bool {
+	for _, event := range events {
+		switch event := event.(type) {
+		case KeyInput:
+			// observers have no input to pass on, Ctrl-C and Ctrl-D detach
+			// them as well
+			if c.role == messages.Role_OBSERVER {
+				if slices.ContainsFunc(event.data, func(b byte) bool { return b == '\x03' || b == '\x04' }) {
+					return false
+				}
+
+				continue
+			}
+
+			// input typed while we reconnect is lost
+			if err := c.sendInput(event.data); err != nil {
+				Debug("Error sending input: %v\r\n", err)
+			}
+		case KeySignal:
+			if c.role == messages.Role_OBSERVER {
+				continue
+			}
+
+			message := &messages.Message{
+				Type: messages.MessageType_SIGNAL,
+				Message: &messages.Message_Signal{
+					Signal: &messages.SignalMessage{
+						Signal: event.signal,
+					},
+				},
+			}
+
+			if err := c.send(message); err != nil {
+				Debug("Error sending signal: %v\r\n", err)
+			}
+		case KeyDetach:
+			Info("Detaching\r\n")
+			return false
+		}
+	}
+
+	return true
+}
+
+// sendInput sends data as user input, split to the message size.
+func (c *Client) sendInput(data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, piece := range chunk(data, c.maxMessageSize) {
+		message := &messages.Message{
+			Type: messages.MessageType_USER_INPUT,
+			Message: &messages.Message_UserInput{
+				UserInput: &messages.UserInputMessage{
+					Data: piece,
+				},
+			},
+		}
+
+		if err := writeMessage(c.writer, message); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *Client) closeSocket() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.socket != nil {
+		c.socket.Close()
+	}
+}
+
+// receive copies the server's output to stdout until the connection fails.
+// It returns a ServerError when the server dropped us on purpose, and a
+// SessionExit when the session ended.
+func (c *Client) receive() error {
+	for {
+		var message messages.Message
+
+		// the server answers our pings, a silent one is gone
+		c.socket.SetReadDeadline(time.Now().Add(HEARTBEAT_TIMEOUT))
+
+		err := readMessage(c.reader, &message, c.maxMessageSize)
+
+		if err != nil {
+			return err
+		}
+
+		output := message.GetOutput()
+
+		if output != nil {
+			if _, err := c.stdout.Write(output.Data); err != nil {
+				return errStdout{err}
+			}
+
+			// server notices aren't numbered
+			if output.Sequence > 0 {
+				c.lastSequence.Store(output.Sequence)
+			}
+		}
+
+		errorMessage := message.GetError()
+
+		if errorMessage != nil {
+			return ServerError{code: errorMessage.Code, reason: errorMessage.Error}
+		}
+
+		if exit := message.GetExit(); exit != nil {
+			return SessionExit{code: exit.Code, signal: exit.Signal}
+		}
+	}
+}
+
+// errStdout is a failure to write to the terminal, reconnecting won't help.
+type errStdout struct {
+	err error
+}
+
+func (e errStdout) Error() string {
+	return fmt.Sprintf("error writing output: %v", e.err)
+}
+
+// heartbeat pings the server until done is closed.
+func (c *Client) heartbeat(done chan bool) {
+	ticker := time.NewTicker(HEARTBEAT_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ping := &messages.Message{
+				Type: messages.MessageType_PING,
+				Message: &messages.Message_Ping{
+					Ping: &messages.PingMessage{Ack: c.lastSequence.Load()},
+				},
+			}
+
+			// a failed ping shows up as a read timeout
+			if err := c.send(ping); err != nil {
+				Debug("Error sending ping: %v\r\n", err)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
 func (c *Client) Start() error {
 	stdinFd := int(c.stdin.Fd())
 
@@ -122,39 +472,52 @@ func (c *Client) Start() error {
 
 	defer term.Restore(stdinFd, oldState)
 
-	err = c.Register()
+	err = c.connect(false)
 
 	if err != nil {
 		return err
 	}
 
-	defer c.socket.Close()
+	defer func() {
+		c.closing.Store(true)
+		c.closeSocket()
+	}()
 
 	quitChannel := make(chan bool)
 
-	go func() {
-		var message messages.Message
+	// why the connection ended, if not because the user quit
+	errorChannel := make(chan error, 1)
+
+	done := make(chan bool)
+	defer close(done)
 
+	go c.heartbeat(done)
+
+	go func() {
 		for {
-			err := protodelim.UnmarshalOptions{}.UnmarshalFrom(c.reader, &message)
+			err := c.receive()
 
-			if err != nil {
-				Error("Error reading message: %v\r\n", err)
+			if c.closing.Load() {
 				break
 			}
 
-			output := message.GetOutput()
+			var serverErr ServerError
+			var stdoutErr errStdout
+			var sessionExit SessionExit
 
-			if output != nil {
-				_, err = c.stdout.Write(output.Data)
-				if err != nil {
-					break
-				}
+			if errors.As(err, &serverErr) || errors.As(err, &stdoutErr) || errors.As(err, &sessionExit) {
+				errorChannel <- err
+				break
 			}
 
-			errorMessage := message.GetError()
+			Debug("Lost the connection to the server: %v\r\n", err)
+
+			c.closeSocket()
 
-			if errorMessage != nil {
+			if err := c.connect(true); err != nil {
+				if err != errSessionEnded {
+					errorChannel <- fmt.Errorf("lost the connection to the server: %v", err)
+				}
 				break
 			}
 		}
@@ -164,7 +527,7 @@ func (c *Client) Start() error {
 
 	go func() {
 
-		buffer := make([]byte, c.maxMessageSize/2)
+		buffer := make([]byte, STDIN_BUFFER_SIZE)
 
 		for {
 			n, err := c.stdin.Read(buffer)
@@ -173,33 +536,7 @@ func (c *Client) Start() error {
 				break
 			}
 
-			if slices.Contains(buffer[:n], '\x03') {
-				Info("Received Ctrl-C, exiting\r\n")
-				break
-			}
-
-			if slices.Contains(buffer[:n], '\x04') {
-				Info("Received Ctrl-D, exiting\r\n")
-				break
-			}
-
-			message := &messages.Message{
-				Type: messages.MessageType_USER_INPUT,
-				Message: &messages.Message_UserInput{
-					UserInput: &messages.UserInputMessage{
-						Data: buffer[:n],
-					},
-				},
-			}
-
-			_, err = protodelim.MarshalTo(c.writer, message)
-
-			if err != nil {
-				break
-			}
-
-			err = c.writer.Flush()
-			if err != nil {
+			if !c.handleKeys(c.keys.Feed(buffer[:n])) {
 				break
 			}
 		}
@@ -230,18 +567,19 @@ mainloop:
 					},
 				},
 			}
-			_, err = protodelim.MarshalTo(c.writer, resizeMessage)
 
-			if err != nil {
+			if err := c.send(resizeMessage); err != nil {
 				Error("Error sending resize message: %v\r\n", err)
-				break mainloop
 			}
-
-			c.writer.Flush()
 		case <-quitChannel:
 			break mainloop
 		}
 	}
 
-	return nil
+	select {
+	case err := <-errorChannel:
+		return err
+	default:
+		return nil
+	}
 }
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/darfire/layosh/messages"
+	"google.golang.org/protobuf/encoding/protodelim"
+)
+
+const (
+	// clients that may attach to each role of a session
+	MAX_CLIENTS_PER_ROLE = 8
+
+	// messages waiting for a client's writer, past that the client is behind
+	// and its output is dropped until it catches up
+	CLIENT_QUEUE_SIZE = 256
+
+	// the end of the queue that output never takes, so that a client that's
+	// behind still gets its pongs and the exit status
+	CLIENT_CONTROL_RESERVE = 16
+
+	// a client that takes longer to take a message is disconnected
+	CLIENT_WRITE_TIMEOUT = 10 * time.Second
+
+	// how long the clients get to take their last messages when the server
+	// stops
+	CLIENT_FLUSH_TIMEOUT = time.Second
+)
+
+// ResizePolicy decides the terminal size when the clients of a pane have
+// different sizes.
+type ResizePolicy int
+
+const (
+	// ResizeSmallest fits the pane in every client's terminal.
+	ResizeSmallest ResizePolicy = iota
+	// ResizeLeader follows the leader: the last client that asked to lead,
+	// or else the first one attached.
+	ResizeLeader
+)
+
+func (p ResizePolicy) String() string {
+	switch p {
+	case ResizeSmallest:
+		return "smallest"
+	case ResizeLeader:
+		return "leader"
+	default:
+		return fmt.Sprintf("ResizePolicy(%d)", int(p))
+	}
+}
+
+func ParseResizePolicy(value string) (ResizePolicy, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "smallest":
+		return ResizeSmallest, nil
+	case "leader":
+		return ResizeLeader, nil
+	default:
+		return ResizeSmallest, fmt.Errorf("unknown resize policy: %s", value)
+	}
+}
+
+// AttachedClient is a client connection of the session.
+type AttachedClient struct {
+	id uint64
+
+	// SHELL, LLM or OBSERVER
+	role messages.Role
+
+	// the pane whose output the client gets, SHELL or LLM
+	pane messages.Role
+
+	leader bool
+
+	conn   net.Conn
+	writer *bufio.Writer
+
+	width  uint32
+	height uint32
+
+	// negotiated at registration, larger output is split
+	maxMessageSize uint32
+
+	// messages for the writer goroutine, the server loop never blocks on a
+	// slow client
+	queue chan *messages.Message
+
+	// set when the queue was full and output was dropped, the writer then
+	// catches up from the replay buffer
+	behind atomic.Bool
+
+	// wakes the writer up to catch up
+	wake chan struct{}
+
+	// closed on detach, stops the writer
+	done chan struct{}
+
+	// closed when the writer stopped
+	finished chan struct{}
+
+	// the server loop's answer to a CatchUpEvent
+	caughtUp chan []*messages.Message
+
+	// the last output written, written by the writer goroutine only
+	lastSent uint64
+}
+
+func (c *AttachedClient) String() string {
+	return fmt.Sprintf("client %d (%v of %v)", c.id, c.role, c.pane)
+}
+
+// canSendInput tells whether the client's input reaches its pane.
+func (c *AttachedClient) canSendInput() bool {
+	return c.role != messages.Role_OBSERVER
+}
+
+// ClientRegistry holds the clients of a session. It belongs to the server
+// loop: connection and writer goroutines go through events.
+type ClientRegistry struct {
+	// in attach order
+	clients []*AttachedClient
+	nextId  uint64
+
+	policy ResizePolicy
+
+	// the current line of each pane, sent to clients that attach
+	lastLines map[messages.Role][]byte
+
+	// the recent output of each pane, sent to clients that reconnect
+	replays map[messages.Role]*ReplayBuffer
+
+	// the server loop's events, for writers that fell behind
+	events chan<- ServerEvent
+}
+
+func NewClientRegistry(policy ResizePolicy, events chan<- ServerEvent) *ClientRegistry {
+	return &ClientRegistry{
+		policy:    policy,
+		events:    events,
+		lastLines: map[messages.Role][]byte{},
+		replays: map[messages.Role]*ReplayBuffer{
+			messages.Role_SHELL: NewReplayBuffer(REPLAY_BUFFER_BYTES),
+			messages.Role_LLM:   NewReplayBuffer(REPLAY_BUFFER_BYTES),
+		},
+	}
+}
+
+func (r *ClientRegistry) count(role messages.Role, pane messages.Role) int {
+	n := 0
+
+	for _, client := range r.clients {
+		if client.role == role && client.pane == pane {
+			n++
+		}
+	}
+
+	return n
+}
+
+// Attach greets client with registered and the current line of its pane,
+// then starts sending it the pane's output. A client that reconnects gets the
+// output after resumeAfter instead, when it's still buffered.
+func (r *ClientRegistry) Attach(client *AttachedClient, registered *messages.Message, resumeAfter uint64) error {
+	if r.count(client.role, client.pane) >= MAX_CLIENTS_PER_ROLE {
+		return fmt.Errorf("the session already has %d %v clients", MAX_CLIENTS_PER_ROLE, client.role)
+	}
+
+	r.nextId++
+	client.id = r.nextId
+
+	replay := r.replays[client.pane]
+
+	var missed []replayEntry
+	resumed := false
+
+	if resumeAfter > 0 {
+		missed, resumed = replay.Since(resumeAfter)
+	}
+
+	registered.GetRegistered().Resumed = resumed
+
+	// the greeting goes out before any output queued from now on
+	greeting := []*messages.Message{registered}
+
+	if resumed {
+		for _, entry := range missed {
+			greeting = append(greeting, outputMessage(entry.data, entry.sequence))
+		}
+	} else {
+		greeting = append(greeting, outputMessage(r.lastLines[client.pane], replay.sequence))
+	}
+
+	client.queue = make(chan *messages.Message, CLIENT_QUEUE_SIZE)
+	client.wake = make(chan struct{}, 1)
+	client.done = make(chan struct{})
+	client.finished = make(chan struct{})
+	client.caughtUp = make(chan []*messages.Message, 1)
+
+	go r.runWriter(client, greeting)
+
+	r.clients = append(r.clients, client)
+
+	Info("Attached %v (resumed: %v), %d clients", client, resumed, len(r.clients))
+
+	return nil
+}
+
+func (r *ClientRegistry) Detach(client *AttachedClient) {
+	if !slices.Contains(r.clients, client) {
+		return
+	}
+
+	r.clients = slices.DeleteFunc(r.clients, func(c *AttachedClient) bool { return c == client })
+
+	close(client.done)
+
+	Info("Detached %v, %d clients", client, len(r.clients))
+}
+
+// Output queues data for every client of pane. It doesn't wait for them:
+// a client whose queue is full, short of the control reserve, misses the
+// output until its writer catches up.
+func (r *ClientRegistry) Output(pane messages.Role, data []byte) {
+	r.lastLines[pane] = keepLastLine(r.lastLines[pane], data)
+
+	message := outputMessage(data, r.replays[pane].Add(data))
+
+	for _, client := range r.clients {
+		if client.pane != pane || client.behind.Load() {
+			continue
+		}
+
+		// only the server loop queues, the writer can only make room
+		if len(client.queue) < CLIENT_QUEUE_SIZE-CLIENT_CONTROL_RESERVE {
+			client.queue <- message
+			continue
+		}
+
+		Warn("%v is falling behind, dropping its output", client)
+
+		client.behind.Store(true)
+
+		select {
+		case client.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// runWriter writes the client's queue to its connection, then catches up
+// on the output it missed whenever it fell behind. A nil message stops it.
+func (r *ClientRegistry) runWriter(client *AttachedClient, greeting []*messages.Message) {
+	defer close(client.finished)
+
+	for _, message := range greeting {
+		if !r.write(client, message) {
+			return
+		}
+	}
+
+	for {
+		select {
+		case message := <-client.queue:
+			if message == nil || !r.write(client, message) {
+				return
+			}
+		case <-client.wake:
+		case <-client.done:
+			return
+		}
+
+		if len(client.queue) > 0 || !client.behind.Load() {
+			continue
+		}
+
+		select {
+		case r.events <- CatchUpEvent{client: client, lastSent: client.lastSent}:
+		case <-client.done:
+			return
+		}
+
+		var missed []*messages.Message
+
+		select {
+		case missed = <-client.caughtUp:
+		case <-client.done:
+			return
+		}
+
+		for _, message := range missed {
+			if !r.write(client, message) {
+				return
+			}
+		}
+	}
+}
+
+// catchUp returns what a client missed while it was behind, from the replay
+// buffer, or the current line when that's gone too. Output is queued for it
+// again from here on.
+func (r *ClientRegistry) catchUp(client *AttachedClient, lastSent uint64) []*messages.Message {
+	client.behind.Store(false)
+
+	replay := r.replays[client.pane]
+
+	missed, ok := replay.Since(lastSent)
+
+	Info("%v caught up (from the replay buffer: %v)", client, ok)
+
+	if !ok {
+		return []*messages.Message{
+			outputMessage([]byte("\r\n\x1b[33m[layosh: output skipped, the connection was too slow]\x1b[0m\r\n"), 0),
+			outputMessage(r.lastLines[client.pane], replay.sequence),
+		}
+	}
+
+	var out []*messages.Message
+
+	for _, entry := range missed {
+		out = append(out, outputMessage(entry.data, entry.sequence))
+	}
+
+	return out
+}
+
+// write sends one message, split to the client's message size, and
+// disconnects the client when that fails or takes too long. Writer goroutine
+// only.
+func (r *ClientRegistry) write(client *AttachedClient, message *messages.Message) bool {
+	for _, piece := range splitOutput(message, client.maxMessageSize) {
+		client.conn.SetWriteDeadline(time.Now().Add(CLIENT_WRITE_TIMEOUT))
+
+		if err := writeMessage(client.writer, piece); err != nil {
+			Error("Error writing to %v, disconnecting it: %v", client, err)
+			client.conn.Close()
+			return false
+		}
+	}
+
+	if output := message.GetOutput(); output != nil && output.Sequence > 0 {
+		client.lastSent = output.Sequence
+	}
+
+	return true
+}
+
+// Resize records a client's terminal size and returns the size of its pane.
+func (r *ClientRegistry) Resize(client *AttachedClient, width, height uint32) (Size, bool) {
+	client.width, client.height = width, height
+
+	return r.size(client.pane)
+}
+
+// Size returns the size of pane under the resize policy, false while no
+// client of the pane reported one.
+func (r *ClientRegistry) Size(pane messages.Role) (Size, bool) {
+	return r.size(pane)
+}
+
+func (r *ClientRegistry) size(pane messages.Role) (Size, bool) {
+	var sized []*AttachedClient
+
+	for _, client := range r.clients {
+		if client.pane == pane && client.width > 0 && client.height > 0 {
+			sized = append(sized, client)
+		}
+	}
+
+	if len(sized) == 0 {
+		return Size{}, false
+	}
+
+	if r.policy == ResizeLeader {
+		var leader *AttachedClient
+
+		for _, client := range sized {
+			if client.leader || (leader == nil && client.canSendInput()) {
+				leader = client
+			}
+		}
+
+		if leader != nil {
+			return Size{Width: leader.width, Height: leader.height}, true
+		}
+	}
+
+	size := Size{Width: sized[0].width, Height: sized[0].height}
+
+	for _, client := range sized[1:] {
+		size.Width = min(size.Width, client.width)
+		size.Height = min(size.Height, client.height)
+	}
+
+	return size, true
+}
+
+// CloseAll disconnects every client, once they took what's queued for them
+// or the flush timeout passed.
+func (r *ClientRegistry) CloseAll() {
+	clients := r.clients
+	r.clients = nil
+
+	for _, client := range clients {
+		select {
+		case client.queue <- nil:
+		default:
+			// behind anyway
+			client.conn.Close()
+		}
+	}
+
+	timeout := time.After(CLIENT_FLUSH_TIMEOUT)
+
+	for _, client := range clients {
+		select {
+		case <-client.finished:
+		case <-timeout:
+		}
+
+		close(client.done)
+		client.conn.Close()
+	}
+}
+
+// Send queues a control message for one client, in between the pane's
+// output. It may take the reserve, so it only fails for a client that has
+// stopped reading altogether, which the write timeout disconnects.
+func (r *ClientRegistry) Send(client *AttachedClient, message *messages.Message) error {
+	select {
+	case client.queue <- message:
+		return nil
+	default:
+		return fmt.Errorf("%v isn't reading", client)
+	}
+}
+
+// Broadcast queues a control message for every client. Those that stopped
+// reading go without, they find out when the connection closes.
+func (r *ClientRegistry) Broadcast(message *messages.Message) {
+	for _, client := range r.clients {
+		if err := r.Send(client, message); err != nil {
+			Debug("Not sending %v: %v", message.Type, err)
+		}
+	}
+}
+
+func outputMessage(data []byte, sequence uint64) *messages.Message {
+	return &messages.Message{
+		Type: messages.MessageType_OUTPUT,
+		Message: &messages.Message_Output{
+			Output: &messages.OutputMessage{
+				Data:     data,
+				Sequence: sequence,
+			},
+		},
+	}
+}
+
+func writeMessage(writer *bufio.Writer, message *messages.Message) error {
+	if _, err := protodelim.MarshalTo(writer, message); err != nil {
+		return err
+	}
+
+	return writer.Flush()
+}
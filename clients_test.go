@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/darfire/layosh/messages"
+)
+
+// readUntil reads output until the message numbered sequence.
+func readUntil(reader *bufio.Reader, sequence uint64) error {
+	for {
+		var message messages.Message
+
+		if err := readMessage(reader, &message, MAX_MESSAGE_SIZE); err != nil {
+			return err
+		}
+
+		if output := message.GetOutput(); output != nil && output.Sequence >= sequence {
+			return nil
+		}
+	}
+}
+
+// benchmarkOutput sends b.N lines of shell output through the server loop
+// to fast clients, with stalled clients attached as well. The stalled ones
+// never read, so their writers hang on the pipe.
+func benchmarkOutput(b *testing.B, fast int, stalled int) {
+	// the hangups at the end would show up among the results
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	s := newTestServer()
+
+	output := make(chan []byte)
+	stop := make(chan struct{})
+
+	loopDone := runTestLoop(s, output, stop)
+
+	var conns []net.Conn
+	var served []<-chan struct{}
+
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+
+		close(stop)
+		<-loopDone
+
+		for _, done := range served {
+			<-done
+		}
+	}()
+
+	for range stalled {
+		conn, _, done, err := dialTestServer(s, messages.Role_OBSERVER, messages.Role_SHELL)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		conns = append(conns, conn)
+		served = append(served, done)
+	}
+
+	results := make(chan error, fast)
+
+	for range fast {
+		conn, reader, done, err := dialTestServer(s, messages.Role_OBSERVER, messages.Role_SHELL)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		conns = append(conns, conn)
+		served = append(served, done)
+
+		go func() {
+			results <- readUntil(reader, uint64(b.N))
+		}()
+	}
+
+	line := append(bytes.Repeat([]byte("x"), 78), '\r', '\n')
+
+	b.SetBytes(int64(len(line)))
+	b.ResetTimer()
+
+	for range b.N {
+		output <- line
+	}
+
+	for range fast {
+		if err := <-results; err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.StopTimer()
+}
+
+// BenchmarkOutputSlowClient shows that a client that stops reading costs
+// neither the server loop nor the other clients their throughput: compare
+// the stalled runs with the one without.
+func BenchmarkOutputSlowClient(b *testing.B) {
+	for _, stalled := range []int{0, 1, 4} {
+		b.Run(fmt.Sprintf("stalled=%d", stalled), func(b *testing.B) {
+			benchmarkOutput(b, 4, stalled)
+		})
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// how much output we keep per logged command
+	COMMAND_LOG_OUTPUT_BYTES = 16 * 1024
+
+	// how many finished commands we remember
+	COMMAND_LOG_SIZE = 50
+)
+
+// The completion marker is an OSC sequence with a private number, which
+// terminals ignore. printf writes it from octal escapes, so the echoed
+// command line never contains the marker itself.
+var completionMarker = regexp.MustCompile(`\x1b\]7770;layosh-done;([0-9a-f-]+);([0-9]+)\x07`)
+
+// withCompletionMarker makes a POSIX shell report id and the exit status of
+// command once it finishes. The marker goes on a line of its own, where a
+// trailing comment can't swallow it, and the group is read whole before it
+// runs, so a command reading stdin doesn't get the marker line either.
+func withCompletionMarker(command string, id string) string {
+	return fmt.Sprintf("{ %s\n}; %s", trimCommand(command), completionMarkerCommand(id))
+}
+
+// completionMarkerCommand prints the marker for id with the exit status of
+// the previous command.
+func completionMarkerCommand(id string) string {
+	return fmt.Sprintf(`printf '\033]7770;layosh-done;%s;%%d\007' "$?"`, id)
+}
+
+// trimCommand drops trailing blanks and a dangling backslash, which would
+// join the next line to the command.
+func trimCommand(command string) string {
+	return strings.TrimRight(command, " \t\r\n\\")
+}
+
+type CommandLogEntry struct {
+	id      string
+	command string
+
+	output *recentBuffer
+
+	exitCode int
+	done     bool
+}
+
+// CommandResult is sent to the LLM wrapper when a logged command finishes.
+type CommandResult struct {
+	id       string
+	command  string
+	output   string
+	exitCode int
+}
+
+// CommandLog follows commands we inject into the shell, collects their
+// output and picks up their exit status from the completion marker.
+type CommandLog struct {
+	running  []*CommandLogEntry
+	finished []*CommandLogEntry
+}
+
+func NewCommandLog() *CommandLog {
+	return &CommandLog{}
+}
+
+func (l *CommandLog) Start(id string, command string) {
+	l.running = append(l.running, &CommandLogEntry{
+		id:      id,
+		command: command,
+		output:  newRecentBuffer(COMMAND_LOG_OUTPUT_BYTES),
+	})
+
+	// commands that never report back, e.g. in a non-POSIX REPL
+	if len(l.running) > COMMAND_LOG_SIZE {
+		l.running = l.running[len(l.running)-COMMAND_LOG_SIZE:]
+	}
+}
+
+// Feed adds shell output to the running commands and returns the ones that
+// finished.
+func (l *CommandLog) Feed(data []byte) []CommandResult {
+	var results []CommandResult
+
+	if len(l.running) == 0 {
+		return nil
+	}
+
+	still := l.running[:0]
+
+	for _, entry := range l.running {
+		entry.output.Write(data)
+
+		output := entry.output.String()
+
+		for _, match := range completionMarker.FindAllStringSubmatchIndex(output, -1) {
+			if output[match[2]:match[3]] != entry.id {
+				continue
+			}
+
+			entry.exitCode, _ = strconv.Atoi(output[match[4]:match[5]])
+			entry.done = true
+
+			results = append(results, CommandResult{
+				id:       entry.id,
+				command:  entry.command,
+				output:   normalizeTerminalText(output[:match[0]]),
+				exitCode: entry.exitCode,
+			})
+
+			break
+		}
+
+		if entry.done {
+			l.finish(entry)
+		} else {
+			still = append(still, entry)
+		}
+	}
+
+	l.running = still
+
+	return results
+}
+
+// Abandon gives up on the running commands, e.g. because the shell they ran
+// in is gone, and returns them as failed.
+func (l *CommandLog) Abandon(reason string) []CommandResult {
+	var results []CommandResult
+
+	for _, entry := range l.running {
+		entry.exitCode = -1
+		entry.done = true
+
+		results = append(results, CommandResult{
+			id:       entry.id,
+			command:  entry.command,
+			output:   normalizeTerminalText(entry.output.String()) + reason + "\n",
+			exitCode: entry.exitCode,
+		})
+
+		l.finish(entry)
+	}
+
+	l.running = nil
+
+	return results
+}
+
+func (l *CommandLog) finish(entry *CommandLogEntry) {
+	l.finished = append(l.finished, entry)
+
+	if len(l.finished) > COMMAND_LOG_SIZE {
+		l.finished = l.finished[len(l.finished)-COMMAND_LOG_SIZE:]
+	}
+}
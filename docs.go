@@ -0,0 +1,433 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+const (
+	// how much documentation goes into a prompt, per program and in total
+	DOC_PROGRAM_BYTES = 2 * 1024
+	DOC_PROMPT_BYTES  = 6 * 1024
+
+	// how many programs mentioned in a request we look up
+	DOC_MAX_PROGRAMS = 3
+)
+
+var (
+	overstrike = regexp.MustCompile(".\x08")
+
+	// flags as documented: "-f, --file=ARCHIVE", "[-v]", "--[no-]color"
+	documentedFlag = regexp.MustCompile(`(?:^|[\s,\[|(])(--?)(\[no-?\])?([A-Za-z0-9?#@][A-Za-z0-9_.-]*)`)
+
+	requestWord = regexp.MustCompile(`[A-Za-z0-9][A-Za-z0-9._+-]*`)
+
+	// words that name programs but rarely mean them in a request
+	docStopWords = []string{
+		"a", "an", "and", "are", "as", "at", "be", "by", "do", "for", "from", "how", "i", "in", "is",
+		"it", "me", "my", "of", "on", "or", "show", "the", "this", "to", "what", "with", "all", "files",
+		"size", "yes", "true", "false", "test", "last", "users",
+	}
+
+	// commands that run the command that follows them
+	commandWrappers = []string{"sudo", "env", "nohup", "time", "nice", "command", "exec", "doas"}
+)
+
+// Documentation is the local man page or --help output of a program, split
+// into paragraphs, with the flags it mentions.
+type Documentation struct {
+	name string
+	text string
+
+	paragraphs []string
+	flags      map[string]bool
+}
+
+type docEntry struct {
+	doc *Documentation
+
+	// whether --help was tried, not just the man page
+	triedHelp bool
+}
+
+// DocIndex caches the documentation of the programs seen in a session.
+type DocIndex struct {
+	entries map[string]*docEntry
+}
+
+func NewDocIndex() *DocIndex {
+	return &DocIndex{
+		entries: map[string]*docEntry{},
+	}
+}
+
+func NewDocumentation(name string, text string) *Documentation {
+	text = overstrike.ReplaceAllString(text, "")
+	// man hyphenates with U+2010
+	text = strings.ReplaceAll(text, "\u2010", "-")
+
+	doc := &Documentation{
+		name:  name,
+		text:  text,
+		flags: map[string]bool{},
+	}
+
+	for _, paragraph := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n\n") {
+		if strings.TrimSpace(paragraph) != "" {
+			doc.paragraphs = append(doc.paragraphs, strings.Trim(paragraph, "\n"))
+		}
+	}
+
+	for _, match := range documentedFlag.FindAllStringSubmatch(text, -1) {
+		doc.flags[match[1]+match[3]] = true
+
+		if match[2] != "" {
+			doc.flags[match[1]+strings.Trim(match[2], "[]")+match[3]] = true
+		}
+	}
+
+	return doc
+}
+
+// Lookup returns the documentation of name, or nil when there is none. The
+// man page is preferred; --help is only run when help is true, as we don't
+// want to run every word of a request.
+func (d *DocIndex) Lookup(ctx context.Context, name string, help bool) *Documentation {
+	entry, ok := d.entries[name]
+
+	if ok && (entry.doc != nil || entry.triedHelp || !help) {
+		return entry.doc
+	}
+
+	if !ok {
+		entry = &docEntry{}
+		d.entries[name] = entry
+
+		if text, err := manPage(ctx, name); err == nil {
+			entry.doc = NewDocumentation(name, text)
+			return entry.doc
+		}
+	}
+
+	if help {
+		entry.triedHelp = true
+
+		if text, err := helpOutput(ctx, name); err == nil && documentedFlag.MatchString(text) {
+			entry.doc = NewDocumentation(name, text)
+		}
+	}
+
+	return entry.doc
+}
+
+// Relevant returns the paragraphs that best match words, the synopsis first,
+// at most limit bytes.
+func (doc *Documentation) Relevant(words []string, limit int) string {
+	type scored struct {
+		index int
+		score int
+	}
+
+	var candidates []scored
+
+	for i, paragraph := range doc.paragraphs {
+		lower := strings.ToLower(paragraph)
+		score := 0
+
+		for _, word := range words {
+			if len(word) >= 3 && strings.Contains(lower, word) {
+				score++
+			}
+		}
+
+		if i < 3 && (strings.Contains(paragraph, "SYNOPSIS") || strings.HasPrefix(strings.TrimSpace(lower), "usage:")) {
+			score += 100
+		}
+
+		if score > 0 {
+			candidates = append(candidates, scored{i, score})
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].score > candidates[j].score
+	})
+
+	var picked []int
+	size := 0
+
+	for _, candidate := range candidates {
+		paragraph := doc.paragraphs[candidate.index]
+
+		if size+len(paragraph) > limit {
+			continue
+		}
+
+		picked = append(picked, candidate.index)
+		size += len(paragraph) + 1
+	}
+
+	// keep the document order
+	slices.Sort(picked)
+
+	var out strings.Builder
+
+	for _, i := range picked {
+		out.WriteString(doc.paragraphs[i])
+		out.WriteString("\n")
+	}
+
+	return out.String()
+}
+
+// mentionedPrograms returns the installed programs a request names.
+func mentionedPrograms(request string) []string {
+	var programs []string
+
+	for _, word := range requestWord.FindAllString(request, -1) {
+		if len(programs) == DOC_MAX_PROGRAMS {
+			break
+		}
+
+		if slices.Contains(docStopWords, strings.ToLower(word)) || slices.Contains(programs, word) {
+			continue
+		}
+
+		if _, err := exec.LookPath(word); err == nil {
+			programs = append(programs, word)
+		}
+	}
+
+	return programs
+}
+
+// groundingDocs returns the relevant local documentation of the programs a
+// request mentions, for the prompt.
+func (l *LLMWrapper) groundingDocs(ctx context.Context, request string) string {
+	if !l.settings.docs {
+		return ""
+	}
+
+	words := strings.Fields(strings.ToLower(request))
+
+	var out strings.Builder
+
+	for _, program := range mentionedPrograms(request) {
+		doc := l.docs.Lookup(ctx, program, false)
+		if doc == nil {
+			continue
+		}
+
+		relevant := doc.Relevant(words, min(DOC_PROGRAM_BYTES, DOC_PROMPT_BYTES-out.Len()))
+		if relevant == "" {
+			continue
+		}
+
+		fmt.Fprintf(&out, "DOCUMENTATION OF %s:\n%s\n", program, relevant)
+	}
+
+	if out.Len() == 0 {
+		return ""
+	}
+
+	return "LOCAL DOCUMENTATION BELOW, only use flags documented there for these programs:\n" + out.String()
+}
+
+// splitCommand splits a command line into the simple commands of a
+// pipeline or list, each as words. Quotes are honoured, anything fancier
+// (substitutions, here documents) is not.
+func splitCommand(command string) [][]string {
+	var commands [][]string
+	var words []string
+	var word strings.Builder
+
+	inWord := false
+	quote := rune(0)
+
+	endWord := func() {
+		if inWord {
+			words = append(words, word.String())
+			word.Reset()
+			inWord = false
+		}
+	}
+
+	endCommand := func() {
+		endWord()
+
+		if len(words) > 0 {
+			commands = append(commands, words)
+			words = nil
+		}
+	}
+
+	runes := []rune(command)
+
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else if r == '\\' && quote == '"' && i+1 < len(runes) {
+				i++
+				word.WriteRune(runes[i])
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inWord = true
+		case r == '\\' && i+1 < len(runes):
+			i++
+			word.WriteRune(runes[i])
+			inWord = true
+		case r == '|' || r == ';' || r == '&' || r == '\n' || r == '(' || r == ')':
+			endCommand()
+		case r == ' ' || r == '\t':
+			endWord()
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+
+	endCommand()
+
+	return commands
+}
+
+// commandFlags returns the program a simple command runs, a possible
+// subcommand and the flags passed to it.
+func commandFlags(words []string) (string, string, []string) {
+	for len(words) > 0 && strings.Contains(words[0], "=") && !strings.HasPrefix(words[0], "-") {
+		words = words[1:]
+	}
+
+	if len(words) > 0 && slices.Contains(commandWrappers, words[0]) {
+		words = words[1:]
+
+		// the wrapper's own options, we can't tell where the command starts
+		if len(words) > 0 && strings.HasPrefix(words[0], "-") {
+			return "", "", nil
+		}
+	}
+
+	if len(words) == 0 || strings.ContainsAny(words[0], "$`<>{}") {
+		return "", "", nil
+	}
+
+	program := words[0]
+	if i := strings.LastIndex(program, "/"); i >= 0 {
+		program = program[i+1:]
+	}
+
+	subcommand := ""
+	if len(words) > 1 && requestWord.MatchString(words[1]) && !strings.ContainsAny(words[1], "/.=") &&
+		!strings.HasPrefix(words[1], "-") {
+		subcommand = words[1]
+	}
+
+	var flags []string
+
+	for _, word := range words[1:] {
+		if word == "--" {
+			break
+		}
+
+		if len(word) < 2 || word[0] != '-' || strings.ContainsAny(word, "$`") {
+			continue
+		}
+
+		// "head -5" and friends
+		if strings.Trim(word[1:], "0123456789") == "" {
+			continue
+		}
+
+		if i := strings.Index(word, "="); i > 0 {
+			word = word[:i]
+		}
+
+		flags = append(flags, word)
+	}
+
+	return program, subcommand, flags
+}
+
+// isDocumented tells whether one of docs mentions flag. Clustered short
+// flags ("-xzf") pass when their first letter is documented, since the
+// rest may be a value ("-ofile").
+func isDocumented(flag string, docs []*Documentation) bool {
+	for _, doc := range docs {
+		if doc.flags[flag] {
+			return true
+		}
+
+		if !strings.HasPrefix(flag, "--") && len(flag) > 2 && doc.flags[flag[:2]] {
+			return true
+		}
+
+		// getopt_long takes unambiguous prefixes, "--col" for "--color"
+		if strings.HasPrefix(flag, "--") {
+			for documented := range doc.flags {
+				if strings.HasPrefix(documented, flag) {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// checkFlags adds a warning to response for each flag that the local
+// documentation of its program doesn't mention.
+func (l *LLMWrapper) checkFlags(ctx context.Context, response *LLMResponse) {
+	if !l.settings.docs {
+		return
+	}
+
+	for _, words := range splitCommand(response.command) {
+		program, subcommand, flags := commandFlags(words)
+		if program == "" || len(flags) == 0 {
+			continue
+		}
+
+		doc := l.docs.Lookup(ctx, program, true)
+		if doc == nil {
+			continue
+		}
+
+		docs := []*Documentation{doc}
+
+		// "git commit" is documented in git-commit(1)
+		if subcommand != "" && strings.Contains(doc.text, subcommand) {
+			if sub := l.docs.Lookup(ctx, program+"-"+subcommand, false); sub != nil {
+				docs = append(docs, sub)
+			} else {
+				// the flags belong to a subcommand we have no documentation for
+				continue
+			}
+		}
+
+		var unknown []string
+
+		for _, flag := range flags {
+			if !isDocumented(flag, docs) && !slices.Contains(unknown, flag) {
+				unknown = append(unknown, flag)
+			}
+		}
+
+		if len(unknown) > 0 {
+			response.warnings = append(response.warnings, fmt.Sprintf(
+				"%s not found in the local documentation of %s",
+				strings.Join(unknown, ", "), program))
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"syscall"
+
+	"github.com/darfire/layosh/messages"
+)
+
+// how many client events may wait for the server loop
+const EVENT_QUEUE_SIZE = 64
+
+// ServerEvent is something a connection goroutine asks the server loop to
+// do. The loop owns the session state, connections never touch it.
+type ServerEvent interface {
+	isServerEvent()
+}
+
+// AttachEvent adds a client that passed registration. The loop answers on
+// reply.
+type AttachEvent struct {
+	client      *AttachedClient
+	registered  *messages.Message
+	resumeAfter uint64
+
+	width  uint32
+	height uint32
+
+	reply chan error
+}
+
+type DetachEvent struct {
+	client *AttachedClient
+}
+
+type InputEvent struct {
+	client *AttachedClient
+	data   []byte
+}
+
+type ResizeEvent struct {
+	client *AttachedClient
+	width  uint32
+	height uint32
+}
+
+type SignalEvent struct {
+	client *AttachedClient
+	signal messages.Signal
+}
+
+type PingEvent struct {
+	client *AttachedClient
+	ack    uint64
+}
+
+// CheckpointEvent brings back a checkpoint taken off the loop, with the
+// suggestion that waited for it.
+type CheckpointEvent struct {
+	response   LLMResponse
+	checkpoint *Checkpoint
+	err        error
+}
+
+// CatchUpEvent asks for the output a client missed after lastSent, the loop
+// answers on the client's caughtUp channel.
+type CatchUpEvent struct {
+	client   *AttachedClient
+	lastSent uint64
+}
+
+func (AttachEvent) isServerEvent()     {}
+func (DetachEvent) isServerEvent()     {}
+func (InputEvent) isServerEvent()      {}
+func (ResizeEvent) isServerEvent()     {}
+func (SignalEvent) isServerEvent()     {}
+func (PingEvent) isServerEvent()       {}
+func (CatchUpEvent) isServerEvent()    {}
+func (CheckpointEvent) isServerEvent() {}
+
+// post hands an event to the server loop, false once the server stopped.
+func (s *Server) post(event ServerEvent) bool {
+	select {
+	case s.events <- event:
+		return true
+	case <-s.stopped:
+		return false
+	}
+}
+
+func (s *Server) handleEvent(event ServerEvent) {
+	switch event := event.(type) {
+	case AttachEvent:
+		err := s.clients.Attach(event.client, event.registered, event.resumeAfter)
+		event.reply <- err
+
+		if err == nil {
+			size, ok := s.clients.Resize(event.client, event.width, event.height)
+			s.resizePane(event.client.pane, size, ok)
+		}
+	case DetachEvent:
+		s.clients.Detach(event.client)
+
+		// under smallest-wins the pane may grow back
+		size, ok := s.clients.Size(event.client.pane)
+		s.resizePane(event.client.pane, size, ok)
+	case InputEvent:
+		if !event.client.canSendInput() {
+			Debug("Dropping input from %v", event.client)
+			return
+		}
+
+		if event.client.pane == messages.Role_SHELL {
+			s.handleShellInput(event.data)
+		} else {
+			s.handleLLMInput(event.data)
+		}
+	case SignalEvent:
+		s.handleSignal(event.client, event.signal)
+	case ResizeEvent:
+		size, ok := s.clients.Resize(event.client, event.width, event.height)
+		s.resizePane(event.client.pane, size, ok)
+	case PingEvent:
+		Debug("Ping from %v, acked %d", event.client, event.ack)
+
+		pong := &messages.Message{
+			Type:    messages.MessageType_PONG,
+			Message: &messages.Message_Pong{Pong: &messages.PongMessage{}},
+		}
+
+		if err := s.clients.Send(event.client, pong); err != nil {
+			Debug("Not sending pong: %v", err)
+		}
+	case CatchUpEvent:
+		event.client.caughtUp <- s.clients.catchUp(event.client, event.lastSent)
+	case CheckpointEvent:
+		s.checkpointDone(event)
+	default:
+		Error("Unknown server event: %T", event)
+	}
+}
+
+// resizePane applies the size the resize policy picked, if any client of
+// the pane reported one.
+func (s *Server) resizePane(pane messages.Role, size Size, ok bool) {
+	if !ok {
+		return
+	}
+
+	Debug("Resizing %v pane to %d x %d", pane, size.Width, size.Height)
+
+	if pane == messages.Role_SHELL {
+		s.shellWrapper.ResizeTerminal(size.Width, size.Height)
+	} else {
+		s.llmWrapper.ResizeTerminal(size.Width, size.Height)
+	}
+}
+
+var ptySignals = map[messages.Signal]syscall.Signal{
+	messages.Signal_INTERRUPT: syscall.SIGINT,
+	messages.Signal_STOP:      syscall.SIGTSTP,
+	messages.Signal_TERMINATE: syscall.SIGTERM,
+}
+
+// handleSignal passes a client's signal on to the shell's foreground
+// processes. The LLM pane has no processes to signal.
+func (s *Server) handleSignal(client *AttachedClient, signal messages.Signal) {
+	sig, ok := ptySignals[signal]
+
+	if !ok || !client.canSendInput() || client.pane != messages.Role_SHELL {
+		Debug("Dropping signal %v from %v", signal, client)
+		return
+	}
+
+	Debug("Sending %v from %v to the shell", sig, client)
+
+	if err := s.shellWrapper.Signal(sig); err != nil {
+		Error("Error sending %v: %v", sig, err)
+	}
+}
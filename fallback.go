@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"time"
+
+	"github.com/firebase/genkit/go/ai"
+	"github.com/firebase/genkit/go/core"
+)
+
+const (
+	// attempts per model before falling back to the next one
+	RETRY_ATTEMPTS = 3
+
+	RETRY_BASE_DELAY = 500 * time.Millisecond
+	RETRY_MAX_DELAY  = 8 * time.Second
+
+	// consecutive failed requests that open a provider's circuit breaker
+	BREAKER_THRESHOLD = 3
+
+	// how long an open breaker skips its provider, doubled each time a
+	// trial request fails
+	BREAKER_COOLDOWN     = 30 * time.Second
+	BREAKER_MAX_COOLDOWN = 10 * time.Minute
+)
+
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// CircuitBreaker stops us from waiting on a provider that keeps failing.
+// Once open, it lets a single trial request through after the cooldown.
+type CircuitBreaker struct {
+	state    BreakerState
+	failures int
+
+	openedAt time.Time
+	cooldown time.Duration
+}
+
+func NewCircuitBreaker() *CircuitBreaker {
+	return &CircuitBreaker{
+		cooldown: BREAKER_COOLDOWN,
+	}
+}
+
+func (b *CircuitBreaker) Allow(now time.Time) bool {
+	if b.state != BreakerOpen {
+		return true
+	}
+
+	if b.cooling(now) {
+		return false
+	}
+
+	b.state = BreakerHalfOpen
+	return true
+}
+
+// cooling tells whether Allow would refuse a request, without changing the
+// state.
+func (b *CircuitBreaker) cooling(now time.Time) bool {
+	return b.state == BreakerOpen && now.Sub(b.openedAt) < b.cooldown
+}
+
+func (b *CircuitBreaker) Success() {
+	b.state = BreakerClosed
+	b.failures = 0
+	b.cooldown = BREAKER_COOLDOWN
+}
+
+func (b *CircuitBreaker) Failure(now time.Time) {
+	b.failures++
+
+	switch {
+	case b.state == BreakerHalfOpen:
+		b.cooldown = min(2*b.cooldown, BREAKER_MAX_COOLDOWN)
+	case b.failures < BREAKER_THRESHOLD:
+		return
+	}
+
+	b.state = BreakerOpen
+	b.openedAt = now
+}
+
+// ChainModel is one model of the fallback chain.
+type ChainModel struct {
+	config ModelConfig
+	model  ai.Model
+
+	// shared by the models of the same provider
+	breaker *CircuitBreaker
+
+	// set once the model rejected tool calls
+	toolsUnsupported bool
+}
+
+func NewChainModel(config ModelConfig, model ai.Model) *ChainModel {
+	return &ChainModel{
+		config: config,
+		model:  model,
+	}
+}
+
+func (m *ChainModel) Name() string {
+	return m.config.String()
+}
+
+// isRetryable tells whether trying the same model again might help.
+func isRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var genkitErr *core.GenkitError
+
+	if errors.As(err, &genkitErr) {
+		return !slices.Contains([]core.StatusName{
+			core.INVALID_ARGUMENT, core.NOT_FOUND, core.PERMISSION_DENIED, core.UNAUTHENTICATED,
+		}, genkitErr.Status)
+	}
+
+	return true
+}
+
+// retryDelay is the exponential backoff before attempt, with jitter.
+func retryDelay(attempt int) time.Duration {
+	delay := min(RETRY_BASE_DELAY<<attempt, RETRY_MAX_DELAY)
+
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// modelContext gives a model its share of what's left of ctx's deadline,
+// split evenly with the models still to try, so that a model that hangs
+// leaves time for its fallbacks.
+func modelContext(ctx context.Context, models []*ChainModel) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return context.WithCancel(ctx)
+	}
+
+	now := time.Now()
+
+	remaining := 0
+	for _, model := range models {
+		if !model.breaker.cooling(now) {
+			remaining++
+		}
+	}
+
+	return context.WithTimeout(ctx, deadline.Sub(now)/time.Duration(max(remaining, 1)))
+}
+
+// generateWithFallback generates structured output from the first model of
+// the chain that answers, retrying each one with backoff. It returns the
+// model that answered.
+func generateWithFallback[T any](l *LLMWrapper, ctx context.Context, prompt string) (*T, *ChainModel, error) {
+	var errs []error
+
+	for i, model := range l.models {
+		if !model.breaker.Allow(time.Now()) {
+			Debug("Skipping %s, the circuit breaker of %s is open\n", model.Name(), model.config.Provider)
+			continue
+		}
+
+		out, err := generateWithRetries[T](l, ctx, model, prompt, l.models[i:])
+
+		if err == nil {
+			model.breaker.Success()
+			return out, model, nil
+		}
+
+		// only the caller gives up on the whole chain
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+
+		// a model the provider rejects says nothing about the provider
+		if isRetryable(err) || errors.Is(err, context.DeadlineExceeded) {
+			model.breaker.Failure(time.Now())
+		}
+
+		errs = append(errs, fmt.Errorf("%s: %w", model.Name(), err))
+
+		if i < len(l.models)-1 {
+			l.logModel("%s failed (%v), falling back", model.Name(), err)
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil, nil, fmt.Errorf("all models are unavailable, their circuit breakers are open")
+	}
+
+	return nil, nil, errors.Join(errs...)
+}
+
+// generateWithRetries tries model up to RETRY_ATTEMPTS times within its
+// share of ctx's deadline.
+func generateWithRetries[T any](l *LLMWrapper, ctx context.Context, model *ChainModel, prompt string, remaining []*ChainModel) (*T, error) {
+	ctx, cancel := modelContext(ctx, remaining)
+	defer cancel()
+
+	var err error
+
+	for attempt := 0; attempt < RETRY_ATTEMPTS; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(retryDelay(attempt - 1)):
+			case <-ctx.Done():
+				return nil, err
+			}
+		}
+
+		var out *T
+
+		out, err = generateData[T](l, ctx, model, ai.WithModel(model.model), ai.WithPrompt(prompt))
+
+		if err == nil {
+			return out, nil
+		}
+
+		Warn("Model %s failed (attempt %d): %v\n", model.Name(), attempt+1, err)
+
+		if ctx.Err() != nil || !isRetryable(err) {
+			break
+		}
+	}
+
+	return nil, err
+}
+
+// logModel shows a model switch in the LLM pane.
+func (l *LLMWrapper) logModel(format string, args ...interface{}) {
+	text := sanitizeTerminalText(fmt.Sprintf(format, args...), SanitizeStrip)
+	l.outputChannel <- "\x1b[90m[model] " + text + "\r\n\x1b[0m"
+}
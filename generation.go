@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/firebase/genkit/go/ai"
+	"github.com/firebase/genkit/go/plugins/compat_oai"
+	"github.com/firebase/genkit/go/plugins/googlegenai"
+)
+
+var generationKeys = []string{"temperature", "top_p", "max_tokens", "stop", "seed", "system"}
+
+// GenerationConfig holds the generation parameters passed to the models.
+// Zero values leave the provider's default.
+type GenerationConfig struct {
+	temperature float64
+	topP        float64
+	maxTokens   int
+	stop        []string
+
+	seed    int64
+	hasSeed bool
+
+	// extra instructions, sent as the system prompt
+	system string
+}
+
+// providerLimits describes which generation parameters a provider takes,
+// as far as its genkit plugin passes them on.
+type providerLimits struct {
+	options        bool
+	seed           bool
+	maxTemperature float64
+	maxStop        int
+}
+
+var generationLimits = map[string]providerLimits{
+	"googleai": {options: true, maxTemperature: 2, maxStop: 5},
+	"openai":   {options: true, maxTemperature: 2, maxStop: 4},
+
+	// the genkit Ollama plugin doesn't pass options on to the server
+	"ollama": {},
+}
+
+// parseStop reads stop sequences as a JSON array, or comma-separated.
+func parseStop(value string) ([]string, error) {
+	if strings.HasPrefix(strings.TrimSpace(value), "[") {
+		var stop []string
+		err := json.Unmarshal([]byte(value), &stop)
+		return stop, err
+	}
+
+	var stop []string
+
+	for _, sequence := range strings.Split(value, ",") {
+		if sequence != "" {
+			stop = append(stop, sequence)
+		}
+	}
+
+	return stop, nil
+}
+
+// update sets one generation parameter; "default" resets it.
+func (g *GenerationConfig) update(key string, value string) error {
+	reset := value == "default" || value == "none"
+
+	var err error
+
+	switch key {
+	case "temperature":
+		g.temperature = 0
+		if !reset {
+			g.temperature, err = strconv.ParseFloat(value, 64)
+			if err != nil || g.temperature <= 0 {
+				// the plugins treat 0 as unset, use e.g. 0.01 for near-deterministic output
+				return fmt.Errorf("invalid value for temperature: %s, it must be above 0", value)
+			}
+		}
+	case "top_p":
+		g.topP = 0
+		if !reset {
+			g.topP, err = strconv.ParseFloat(value, 64)
+			if err != nil || g.topP <= 0 || g.topP > 1 {
+				return fmt.Errorf("invalid value for top_p: %s, it must be in (0, 1]", value)
+			}
+		}
+	case "max_tokens":
+		g.maxTokens = 0
+		if !reset {
+			g.maxTokens, err = strconv.Atoi(value)
+			if err != nil || g.maxTokens <= 0 {
+				return fmt.Errorf("invalid value for max_tokens: %s", value)
+			}
+		}
+	case "stop":
+		g.stop = nil
+		if !reset {
+			g.stop, err = parseStop(value)
+			if err != nil {
+				return fmt.Errorf("invalid value for stop: %s", value)
+			}
+		}
+	case "seed":
+		g.seed, g.hasSeed = 0, false
+		if !reset {
+			g.seed, err = strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid value for seed: %s", value)
+			}
+			g.hasSeed = true
+		}
+	case "system":
+		g.system = ""
+		if !reset {
+			g.system = value
+		}
+	default:
+		return fmt.Errorf("unknown setting: %s", key)
+	}
+
+	return nil
+}
+
+func (g *GenerationConfig) hasOptions() bool {
+	return g.temperature != 0 || g.topP != 0 || g.maxTokens != 0 || len(g.stop) > 0
+}
+
+// Check validates the parameters against provider. It returns the set
+// parameters the provider ignores, and an error for values it rejects.
+func (g *GenerationConfig) Check(provider string) ([]string, error) {
+	limits, ok := generationLimits[provider]
+	if !ok {
+		return nil, nil
+	}
+
+	var ignored []string
+
+	if g.hasSeed && !limits.seed {
+		ignored = append(ignored, "seed")
+	}
+
+	if !limits.options {
+		if g.hasOptions() {
+			ignored = append(ignored, "temperature, top_p, max_tokens and stop")
+		}
+
+		return ignored, nil
+	}
+
+	if g.temperature > limits.maxTemperature {
+		return ignored, fmt.Errorf("%s takes a temperature up to %v", provider, limits.maxTemperature)
+	}
+
+	if len(g.stop) > limits.maxStop {
+		return ignored, fmt.Errorf("%s takes up to %d stop sequences", provider, limits.maxStop)
+	}
+
+	return ignored, nil
+}
+
+// options returns the genkit options carrying the parameters for provider.
+func (g *GenerationConfig) options(provider string) []ai.GenerateOption {
+	var options []ai.GenerateOption
+
+	if g.system != "" {
+		options = append(options, ai.WithSystem("%s", g.system))
+	}
+
+	if !generationLimits[provider].options || !g.hasOptions() {
+		return options
+	}
+
+	switch provider {
+	case "googleai":
+		options = append(options, ai.WithConfig(&googlegenai.GeminiConfig{
+			Temperature:     g.temperature,
+			TopP:            g.topP,
+			MaxOutputTokens: g.maxTokens,
+			StopSequences:   g.stop,
+		}))
+	case "openai":
+		options = append(options, ai.WithConfig(&compat_oai.OpenAIConfig{
+			Temperature:     g.temperature,
+			TopP:            g.topP,
+			MaxOutputTokens: g.maxTokens,
+			StopSequences:   g.stop,
+		}))
+	}
+
+	return options
+}
+
+func (g *GenerationConfig) describe() string {
+	var parts []string
+
+	if g.temperature != 0 {
+		parts = append(parts, fmt.Sprintf("temperature=%v", g.temperature))
+	}
+
+	if g.topP != 0 {
+		parts = append(parts, fmt.Sprintf("top_p=%v", g.topP))
+	}
+
+	if g.maxTokens != 0 {
+		parts = append(parts, fmt.Sprintf("max_tokens=%v", g.maxTokens))
+	}
+
+	if len(g.stop) > 0 {
+		stop, _ := json.Marshal(g.stop)
+		parts = append(parts, fmt.Sprintf("stop=%s", stop))
+	}
+
+	if g.hasSeed {
+		parts = append(parts, fmt.Sprintf("seed=%v", g.seed))
+	}
+
+	if g.system != "" {
+		parts = append(parts, fmt.Sprintf("system=%q", g.system))
+	}
+
+	if len(parts) == 0 {
+		return "provider defaults"
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// checkGeneration validates the generation parameters against every model
+// of the chain.
+func (l *LLMWrapper) checkGeneration(models []*ChainModel) ([]string, error) {
+	var warnings []string
+
+	for _, model := range models {
+		ignored, err := l.settings.generation.Check(model.config.Provider)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", model.Name(), err)
+		}
+
+		for _, parameter := range ignored {
+			warnings = append(warnings, fmt.Sprintf("%s ignores %s", model.Name(), parameter))
+		}
+	}
+
+	return warnings, nil
+}
+
+// updateSetting applies /set, rejecting generation parameters a model of
+// the chain can't take.
+func (l *LLMWrapper) updateSetting(key string, value string) error {
+	previous := l.settings.generation
+	previous.stop = slices.Clone(previous.stop)
+
+	if err := l.settings.UpdateFromString(key, value); err != nil {
+		return err
+	}
+
+	if !slices.Contains(generationKeys, key) {
+		return nil
+	}
+
+	warnings, err := l.checkGeneration(l.models)
+	if err != nil {
+		l.settings.generation = previous
+		return err
+	}
+
+	for _, warning := range warnings {
+		l.outputToWarning(warning)
+	}
+
+	return nil
+}
+
+// DefaultConfigPath is where settings are read from when -config isn't
+// given.
+func DefaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(dir, "layosh", "config")
+}
+
+// LoadSettings reads "key value" lines, the same as /set takes, into
+// settings. Blank lines and lines starting with # are skipped.
+func LoadSettings(settings *Settings, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, _ := strings.Cut(line, " ")
+
+		if err := settings.UpdateFromString(key, strings.TrimSpace(value)); err != nil {
+			return fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+	}
+
+	return scanner.Err()
+}
+
+func WithSettings(settings *Settings) func(*LLMWrapper) {
+	return func(l *LLMWrapper) {
+		l.settings = settings
+	}
+}
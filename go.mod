@@ -9,8 +9,10 @@ require (
 	github.com/creack/pty v1.1.24
 	github.com/firebase/genkit/go v0.5.4
 	github.com/google/uuid v1.6.0
+	github.com/openai/openai-go v0.1.0-alpha.65
 	github.com/urfave/cli/v3 v3.3.3
 	github.com/yukinagae/genkit-go-plugins v0.2.2
+	golang.org/x/sys v0.32.0
 	golang.org/x/term v0.31.0
 	google.golang.org/protobuf v1.36.6
 )
@@ -38,7 +40,6 @@ require (
 	github.com/kardianos/osext v0.0.0-20190222173326-2bc1f35cddc0 // indirect
 	github.com/mailru/easyjson v0.9.0 // indirect
 	github.com/mbleigh/raymond v0.0.0-20250414171441-6b3a58ab9e0a // indirect
-	github.com/openai/openai-go v0.1.0-alpha.65 // indirect
 	github.com/pmezard/go-difflib v1.0.1-0.20181226105442-5d4384ee4fb2 // indirect
 	github.com/rthornton128/goncurses v0.0.0-20240804152857-da6485a3b6d7 // indirect
 	github.com/sevlyar/go-daemon v0.1.6 // indirect
@@ -61,7 +62,6 @@ require (
 	golang.org/x/crypto v0.37.0 // indirect
 	golang.org/x/exp v0.0.0-20250408133849-7e4ce0ab07d0 // indirect
 	golang.org/x/net v0.39.0 // indirect
-	golang.org/x/sys v0.32.0 // indirect
 	golang.org/x/text v0.24.0 // indirect
 	google.golang.org/genai v1.5.0 // indirect
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20250414145226-207652e42e2e // indirect
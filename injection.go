@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	// how much recent shell traffic we keep for the injection checks
+	RECENT_SHELL_BYTES = 64 * 1024
+
+	// commands shorter than this are too generic to be flagged as copied
+	MIN_FLAGGED_COMMAND_LENGTH = 8
+)
+
+type injectionPattern struct {
+	description string
+	pattern     *regexp.Regexp
+}
+
+var injectionPatterns = []injectionPattern{
+	{
+		"asks to ignore previous instructions",
+		regexp.MustCompile(`(?i)\b(ignore|disregard|forget|override)\b.{0,30}\b(previous|prior|above|earlier|all|your)\b.{0,20}\b(instructions|prompts?|rules|directions)\b`),
+	},
+	{
+		"addresses an AI assistant directly",
+		regexp.MustCompile(`(?i)\b(you are now|new instructions|system prompt|as an? (ai|llm|language model|assistant))\b`),
+	},
+	{
+		"pipes a download into a shell",
+		regexp.MustCompile(`(?i)\b(curl|wget|fetch)\b[^\n|]*\|\s*(sudo\s+)?(ba|z|da|k)?sh\b`),
+	},
+	{
+		"decodes and executes a payload",
+		regexp.MustCompile(`(?i)\bbase64\s+(-d|--decode)\b[^\n]*\|\s*(sudo\s+)?(ba|z|da|k)?sh\b`),
+	},
+}
+
+// recentBuffer keeps the last limit bytes written to it.
+type recentBuffer struct {
+	data  []byte
+	limit int
+}
+
+func newRecentBuffer(limit int) *recentBuffer {
+	return &recentBuffer{limit: limit}
+}
+
+func (b *recentBuffer) Write(p []byte) {
+	b.data = append(b.data, p...)
+
+	if len(b.data) > b.limit {
+		b.data = b.data[len(b.data)-b.limit:]
+	}
+}
+
+func (b *recentBuffer) String() string {
+	return string(b.data)
+}
+
+func (b *recentBuffer) Reset() {
+	b.data = nil
+}
+
+// normalizeTerminalText removes escape sequences and carriage returns so that
+// captured terminal output can be matched as plain text.
+func normalizeTerminalText(s string) string {
+	s = sanitizeTerminalText(s, SanitizeStrip)
+	return strings.ReplaceAll(s, "\r", "")
+}
+
+// detectPromptInjection runs a set of heuristics over untrusted text and
+// returns a description of every indicator found.
+func detectPromptInjection(text string) []string {
+	text = normalizeTerminalText(text)
+
+	var found []string
+
+	for _, p := range injectionPatterns {
+		if p.pattern.MatchString(text) {
+			found = append(found, p.description)
+		}
+	}
+
+	return found
+}
+
+// commandFromUntrustedOutput reports whether command appears verbatim in the
+// shell output without having been typed by the user (or injected by us).
+func commandFromUntrustedOutput(command string, output string, input string) bool {
+	command = strings.TrimSpace(command)
+
+	if len(command) < MIN_FLAGGED_COMMAND_LENGTH {
+		return false
+	}
+
+	if !strings.Contains(normalizeTerminalText(output), command) {
+		return false
+	}
+
+	return !strings.Contains(normalizeTerminalText(input), command)
+}
+
+// makeDelimiter returns a tag that untrusted content can't guess in advance,
+// so it can't close the block it is quoted in.
+func makeDelimiter() string {
+	nonce := make([]byte, 8)
+
+	if _, err := rand.Read(nonce); err != nil {
+		return "UNTRUSTED"
+	}
+
+	return fmt.Sprintf("UNTRUSTED-%s", hex.EncodeToString(nonce))
+}
+
+func quoteUntrusted(delimiter string, content string) string {
+	content = strings.ReplaceAll(content, delimiter, "")
+	return fmt.Sprintf("<<<%s\n%s\n%s>>>", delimiter, content, delimiter)
+}
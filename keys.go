@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/darfire/layosh/messages"
+)
+
+// Ctrl-], which neither tmux nor the common shells bind
+const DEFAULT_PREFIX_KEY byte = 0x1d
+
+// the keys after the prefix that send signals, the prefix then d detaches
+var prefixSignals = map[byte]messages.Signal{
+	'i': messages.Signal_INTERRUPT,
+	'z': messages.Signal_STOP,
+	't': messages.Signal_TERMINATE,
+}
+
+// ParsePrefixKey reads a key like "ctrl-]" or "C-b".
+func ParsePrefixKey(value string) (byte, error) {
+	key := strings.ToLower(strings.TrimSpace(value))
+
+	for _, modifier := range []string{"ctrl-", "c-", "^"} {
+		if rest, ok := strings.CutPrefix(key, modifier); ok && len(rest) == 1 {
+			c := rest[0]
+
+			if (c >= 'a' && c <= 'z') || strings.IndexByte("@[\\]^_", c) >= 0 {
+				return c & 0x1f, nil
+			}
+		}
+	}
+
+	if len(value) == 1 {
+		return value[0], nil
+	}
+
+	return 0, fmt.Errorf("invalid key: %s, expected e.g. ctrl-b", value)
+}
+
+// PrefixKeys picks prefix key commands out of the client's input, like
+// tmux's prefix. The prefix twice sends the prefix itself.
+type PrefixKeys struct {
+	prefix byte
+
+	// the prefix was the last key, possibly in an earlier read
+	pending bool
+}
+
+func NewPrefixKeys(prefix byte) *PrefixKeys {
+	return &PrefixKeys{
+		prefix: prefix,
+	}
+}
+
+// KeyEvent is what a read from the terminal turns into, after picking out
+// the prefix keys.
+type KeyEvent interface {
+	isKeyEvent()
+}
+
+// KeyInput is input to forward to the server.
+type KeyInput struct {
+	data []byte
+}
+
+type KeySignal struct {
+	signal messages.Signal
+}
+
+type KeyDetach struct{}
+
+func (KeyInput) isKeyEvent()  {}
+func (KeySignal) isKeyEvent() {}
+func (KeyDetach) isKeyEvent() {}
+
+// Feed returns the events in data in the order they were typed, so that
+// input typed after a signal reaches the server after it. Nothing follows
+// a detach.
+func (p *PrefixKeys) Feed(data []byte) []KeyEvent {
+	var events []KeyEvent
+	var input []byte
+
+	flush := func() {
+		if len(input) > 0 {
+			events = append(events, KeyInput{data: input})
+			input = nil
+		}
+	}
+
+	for _, c := range data {
+		if !p.pending {
+			if c == p.prefix {
+				p.pending = true
+			} else {
+				input = append(input, c)
+			}
+
+			continue
+		}
+
+		p.pending = false
+
+		if c == 'd' {
+			flush()
+			return append(events, KeyDetach{})
+		}
+
+		if signal, ok := prefixSignals[c]; ok {
+			flush()
+			events = append(events, KeySignal{signal: signal})
+			continue
+		}
+
+		if c != p.prefix {
+			input = append(input, p.prefix)
+		}
+
+		input = append(input, c)
+	}
+
+	flush()
+
+	return events
+}
@@ -2,10 +2,15 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 
 	"github.com/darfire/layosh/messages"
@@ -73,20 +78,86 @@ func splitProviderModel(model string) (string, string, error) {
 	return provider, modelName, nil
 }
 
-func runServer(cmd *cli.Command) {
-	modelConfig := NewModelConfig()
+// generationFlags maps command line flags to the settings they set.
+var generationFlags = map[string]string{
+	"temperature": "temperature",
+	"top-p":       "top_p",
+	"max-tokens":  "max_tokens",
+	"stop":        "stop",
+	"seed":        "seed",
+	"system":      "system",
+}
 
-	provider, model, err := splitProviderModel(
-		cmd.String("model"))
+// flagValue returns a flag the way /set would take it.
+func flagValue(cmd *cli.Command, name string) string {
+	if name == "stop" {
+		stop, _ := json.Marshal(cmd.StringSlice(name))
+		return string(stop)
+	}
 
-	if err != nil {
-		log.Fatalf("Error parsing model: %s (%v)", cmd.String("model"), err)
+	return fmt.Sprint(cmd.Value(name))
+}
+
+// loadSettings reads the config file, then applies the generation flags over
+// it.
+func loadSettings(cmd *cli.Command) (*Settings, error) {
+	settings := NewSettings()
+
+	path := cmd.String("config")
+
+	if path == "" {
+		path = DefaultConfigPath()
+
+		// the default file is optional
+		if _, err := os.Stat(path); err != nil {
+			path = ""
+		}
+	}
+
+	if path != "" {
+		if err := LoadSettings(settings, path); err != nil {
+			return nil, err
+		}
 	}
 
-	modelConfig.Provider = provider
-	modelConfig.ModelName = model
+	for flag, key := range generationFlags {
+		if !cmd.IsSet(flag) {
+			continue
+		}
 
-	modelConfig.OllamaAddress = cmd.String("ollama-address")
+		if err := settings.UpdateFromString(key, flagValue(cmd, flag)); err != nil {
+			return nil, err
+		}
+	}
+
+	return settings, nil
+}
+
+func runServer(cmd *cli.Command) {
+	var modelConfigs []ModelConfig
+
+	// an ordered fallback chain, e.g. ollama/llama3.2,googleai/gemini-2.0-flash
+	for _, name := range strings.Split(cmd.String("model"), ",") {
+		provider, model, err := splitProviderModel(strings.TrimSpace(name))
+
+		if err != nil {
+			log.Fatalf("Error parsing model: %s (%v)", name, err)
+		}
+
+		modelConfig := NewModelConfig()
+
+		modelConfig.Provider = provider
+		modelConfig.ModelName = model
+
+		modelConfig.OllamaAddress = cmd.String("ollama-address")
+		modelConfig.OpenAIBaseURL = cmd.String("openai-base-url")
+
+		if slices.ContainsFunc(modelConfigs, func(c ModelConfig) bool { return c.String() == modelConfig.String() }) {
+			continue
+		}
+
+		modelConfigs = append(modelConfigs, modelConfig)
+	}
 
 	command := cmd.Args().Slice()
 
@@ -102,7 +173,48 @@ func runServer(cmd *cli.Command) {
 
 	SetDebug(cmd.Bool("debug"))
 
-	server, err := NewServer(modelConfig, command, sessionId)
+	var options []func(*Server)
+
+	if cmd.Bool("sandbox") {
+		cwd, err := os.Getwd()
+		if err != nil {
+			log.Fatalf("Error getting working directory: %v", err)
+		}
+
+		sandbox, err := NewSandbox(cwd, !cmd.Bool("sandbox-offline"), false)
+		if err != nil {
+			log.Fatalf("Error creating sandbox: %v", err)
+		}
+
+		options = append(options, WithSandbox(sandbox))
+	}
+
+	if dir := cmd.String("tldr-pages"); dir != "" {
+		options = append(options, WithLLMOptions(WithTldrPages(dir)))
+	}
+
+	settings, err := loadSettings(cmd)
+	if err != nil {
+		log.Fatalf("Error loading settings: %v", err)
+	}
+
+	options = append(options, WithLLMOptions(WithSettings(settings)))
+
+	policy, err := ParseResizePolicy(cmd.String("resize-policy"))
+	if err != nil {
+		log.Fatalf("Error parsing resize policy: %v", err)
+	}
+
+	options = append(options, WithResizePolicy(policy))
+
+	respawn, err := ParseRespawnPolicy(cmd.String("respawn"))
+	if err != nil {
+		log.Fatalf("Error parsing respawn policy: %v", err)
+	}
+
+	options = append(options, WithRespawnPolicy(respawn))
+
+	server, err := NewServer(modelConfigs, command, sessionId, options...)
 	if err != nil {
 		log.Fatalf("Error creating server: %v", err)
 	}
@@ -116,14 +228,23 @@ func runShellClient(cmd *cli.Command) {
 	SetDebug(debug)
 
 	client, err := NewClient(
-		sessionId, messages.Role_SHELL, os.Stdin, os.Stdout)
+		sessionId, messages.Role_SHELL, os.Stdin, os.Stdout,
+		WithLeader(cmd.Bool("leader")), prefixKeyOption(cmd))
 
 	if err != nil {
 		log.Fatalf("Error creating client: %v", err)
 	}
 
-	if err := client.Start(); err != nil {
-		log.Fatalf("Error starting client: %v", err)
+	err = client.Start()
+
+	if path := cmd.String("exit-status-file"); path != "" && err != nil {
+		if err := os.WriteFile(path, []byte(strconv.Itoa(exitStatus(err))), 0644); err != nil {
+			Error("Error writing the exit status: %v", err)
+		}
+	}
+
+	if err != nil {
+		exitClient(err)
 	}
 }
 
@@ -134,15 +255,105 @@ func runLLMClient(cmd *cli.Command) {
 	SetDebug(debug)
 
 	client, err := NewClient(
-		sessionId, messages.Role_LLM, os.Stdin, os.Stdout)
+		sessionId, messages.Role_LLM, os.Stdin, os.Stdout, prefixKeyOption(cmd))
+	if err != nil {
+		log.Fatalf("Error creating client: %v", err)
+	}
+	if err := client.Start(); err != nil {
+		exitClient(err)
+	}
+}
+
+func runObserverClient(cmd *cli.Command) {
+	sessionId := cmd.Int("session")
+
+	SetDebug(cmd.Bool("debug"))
+
+	var pane messages.Role
+
+	switch cmd.String("watch") {
+	case "shell":
+		pane = messages.Role_SHELL
+	case "llm":
+		pane = messages.Role_LLM
+	default:
+		log.Fatalf("Unknown pane: %s, expected shell or llm", cmd.String("watch"))
+	}
+
+	client, err := NewClient(
+		sessionId, messages.Role_OBSERVER, os.Stdin, os.Stdout,
+		WithWatch(pane), prefixKeyOption(cmd))
 	if err != nil {
 		log.Fatalf("Error creating client: %v", err)
 	}
+
 	if err := client.Start(); err != nil {
-		log.Fatalf("Error starting client: %v", err)
+		exitClient(err)
 	}
 }
 
+func prefixKeyOption(cmd *cli.Command) func(*Client) {
+	prefix, err := ParsePrefixKey(cmd.String("prefix"))
+	if err != nil {
+		log.Fatalf("Error parsing prefix key: %v", err)
+	}
+
+	return WithPrefixKey(prefix)
+}
+
+// exitClient reports why a client stopped, e.g. the server rejected it, and
+// exits non-zero, or with the command's status when the session ended. The
+// terminal is out of raw mode by now.
+func exitClient(err error) {
+	status := exitStatus(err)
+
+	if status != 0 {
+		fmt.Fprintf(os.Stderr, "layosh: %v\n", err)
+	}
+
+	os.Exit(status)
+}
+
+func exitStatus(err error) int {
+	var exit SessionExit
+
+	if errors.As(err, &exit) {
+		return exit.Status()
+	}
+
+	return 1
+}
+
+// the shell client leaves the command's exit status here for the tmux
+// wrapper
+func exitStatusPath(sessionId int) string {
+	return fmt.Sprintf("/tmp/lash-%d/exit-status", sessionId)
+}
+
+// readExitStatus returns the status the shell client left, false when it
+// didn't, e.g. because we were only detached.
+func readExitStatus(path string) (int, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, false
+	}
+
+	status, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, false
+	}
+
+	return status, true
+}
+
+func runSandboxInit(cmd *cli.Command) {
+	err := startSandboxed(
+		cmd.String("lower"), cmd.String("upper"), cmd.String("work"),
+		cmd.Bool("loopback"), cmd.Bool("readonly-root"), cmd.Args().Slice())
+
+	log.Fatalf("Error starting sandboxed command: %v", err)
+}
+
 func runTmux(executable string, cmd *cli.Command) {
 	debug := cmd.Bool("debug")
 	sessionId := cmd.Int("session")
@@ -163,12 +374,75 @@ func runTmux(executable string, cmd *cli.Command) {
 		"-model", cmd.String("model"),
 		"-ollama-address", cmd.String("ollama-address"))
 
+	if url := cmd.String("openai-base-url"); url != "" {
+		serverCmd = serverCmd.append("-openai-base-url", url)
+	}
+
+	if path := cmd.String("config"); path != "" {
+		if abs, err := filepath.Abs(path); err == nil {
+			path = abs
+		}
+
+		serverCmd = serverCmd.append("-config", path)
+	}
+
+	for flag := range generationFlags {
+		if !cmd.IsSet(flag) {
+			continue
+		}
+
+		if flag == "stop" {
+			for _, stop := range cmd.StringSlice(flag) {
+				serverCmd = serverCmd.append("-stop", stop)
+			}
+			continue
+		}
+
+		serverCmd = serverCmd.append("-"+flag, flagValue(cmd, flag))
+	}
+
+	statusPath := exitStatusPath(sessionId)
+
+	// left over from an earlier session with the same id
+	os.Remove(statusPath)
+
 	shellCmd := NewCommand(
-		executable, "shell", "-session", fmt.Sprintf("%d", sessionId))
+		executable, "shell", "-session", fmt.Sprintf("%d", sessionId),
+		"-exit-status-file", statusPath)
 
 	llmCmd := NewCommand(
 		executable, "llm", "-session", fmt.Sprintf("%d", sessionId))
 
+	if cmd.Bool("sandbox") {
+		serverCmd = serverCmd.append("-sandbox")
+	}
+
+	if cmd.Bool("sandbox-offline") {
+		serverCmd = serverCmd.append("-sandbox-offline")
+	}
+
+	if cmd.IsSet("resize-policy") {
+		serverCmd = serverCmd.append("-resize-policy", cmd.String("resize-policy"))
+	}
+
+	if cmd.IsSet("respawn") {
+		serverCmd = serverCmd.append("-respawn", cmd.String("respawn"))
+	}
+
+	if cmd.IsSet("prefix") {
+		shellCmd = shellCmd.append("-prefix", cmd.String("prefix"))
+		llmCmd = llmCmd.append("-prefix", cmd.String("prefix"))
+	}
+
+	if dir := cmd.String("tldr-pages"); dir != "" {
+		// the server may start elsewhere
+		if abs, err := filepath.Abs(dir); err == nil {
+			dir = abs
+		}
+
+		serverCmd = serverCmd.append("-tldr-pages", dir)
+	}
+
 	if debug {
 		serverCmd = serverCmd.append("-debug")
 		shellCmd = shellCmd.append("-debug")
@@ -207,6 +481,14 @@ func runTmux(executable string, cmd *cli.Command) {
 	}
 
 	runTmuxCmd("attach", "-t", fmt.Sprintf("%s:main", tmuxSession))
+
+	// the session ended, rather than we detached: don't leave panes behind,
+	// and exit like the command did
+	if status, ok := readExitStatus(statusPath); ok {
+		exec.Command("tmux", "kill-session", "-t", tmuxSession).Run()
+		os.Remove(statusPath)
+		os.Exit(status)
+	}
 }
 
 func main() {
@@ -238,7 +520,7 @@ func main() {
 					},
 					&cli.StringFlag{
 						Name:  "model",
-						Usage: "model to use",
+						Usage: "model to use, or a comma-separated list of models to fall back through",
 						Value: "googleai/gemini-2.0-flash",
 					},
 					&cli.StringFlag{
@@ -246,6 +528,60 @@ func main() {
 						Usage: "ollama host",
 						Value: "http://localhost:11434",
 					},
+					&cli.StringFlag{
+						Name:  "openai-base-url",
+						Usage: "base URL of an OpenAI-compatible endpoint, for openai/ models",
+					},
+					&cli.StringFlag{
+						Name:  "config",
+						Usage: "file of settings, one \"key value\" per line as taken by /set (default: ~/.config/layosh/config)",
+					},
+					&cli.FloatFlag{
+						Name:  "temperature",
+						Usage: "sampling temperature, above 0",
+					},
+					&cli.FloatFlag{
+						Name:  "top-p",
+						Usage: "nucleus sampling probability mass, in (0, 1]",
+					},
+					&cli.IntFlag{
+						Name:  "max-tokens",
+						Usage: "maximum number of output tokens",
+					},
+					&cli.StringSliceFlag{
+						Name:  "stop",
+						Usage: "stop sequence, may be repeated",
+					},
+					&cli.IntFlag{
+						Name:  "seed",
+						Usage: "sampling seed, where the provider supports it",
+					},
+					&cli.StringFlag{
+						Name:  "system",
+						Usage: "extra instructions for the model, sent as the system prompt",
+					},
+					&cli.BoolFlag{
+						Name:  "sandbox",
+						Usage: "run the command in a namespace sandbox over a copy-on-write overlay of the current directory",
+					},
+					&cli.BoolFlag{
+						Name:  "sandbox-offline",
+						Usage: "give the sandbox its own network namespace, without network access",
+					},
+					&cli.StringFlag{
+						Name:  "tldr-pages",
+						Usage: "directory of tldr-style pages for offline suggestions",
+					},
+					&cli.StringFlag{
+						Name:  "resize-policy",
+						Usage: "terminal size when clients differ: smallest, or leader (the -leader client, else the first attached)",
+						Value: "smallest",
+					},
+					&cli.StringFlag{
+						Name:  "respawn",
+						Usage: "start the command again when it exits: never, always, or on-failure, with backoff",
+						Value: "never",
+					},
 				},
 				Action: func(ctx context.Context, c *cli.Command) error {
 					runServer(c)
@@ -264,12 +600,54 @@ func main() {
 						Name:  "session",
 						Usage: "session id",
 					},
+					&cli.BoolFlag{
+						Name:  "leader",
+						Usage: "set the terminal size under the leader resize policy",
+					},
+					&cli.StringFlag{
+						Name:   "exit-status-file",
+						Usage:  "write the command's exit status here when the session ends (internal)",
+						Hidden: true,
+					},
+					&cli.StringFlag{
+						Name:  "prefix",
+						Usage: "prefix key, then d detaches, i interrupts, z stops, t terminates the foreground job",
+						Value: "ctrl-]",
+					},
 				},
 				Action: func(ctx context.Context, c *cli.Command) error {
 					runShellClient(c)
 					return nil
 				},
 			},
+			{
+				Name:  "observe",
+				Usage: "watch a pane of the session without sending input",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "debug",
+						Usage: "enable debug mode",
+					},
+					&cli.IntFlag{
+						Name:  "session",
+						Usage: "session id",
+					},
+					&cli.StringFlag{
+						Name:  "watch",
+						Usage: "pane to watch, shell or llm",
+						Value: "shell",
+					},
+					&cli.StringFlag{
+						Name:  "prefix",
+						Usage: "prefix key, then d detaches, i interrupts, z stops, t terminates the foreground job",
+						Value: "ctrl-]",
+					},
+				},
+				Action: func(ctx context.Context, c *cli.Command) error {
+					runObserverClient(c)
+					return nil
+				},
+			},
 			{
 				Name:  "llm",
 				Usage: "start the LLM client",
@@ -282,6 +660,11 @@ func main() {
 						Name:  "session",
 						Usage: "session id",
 					},
+					&cli.StringFlag{
+						Name:  "prefix",
+						Usage: "prefix key, then d detaches, i interrupts, z stops, t terminates the foreground job",
+						Value: "ctrl-]",
+					},
 				},
 				Action: func(ctx context.Context, c *cli.Command) error {
 					runLLMClient(c)
@@ -310,7 +693,7 @@ func main() {
 					},
 					&cli.StringFlag{
 						Name:  "model",
-						Usage: "model to use",
+						Usage: "model to use, or a comma-separated list of models to fall back through",
 						Value: "googleai/gemini-2.0-flash",
 					},
 					&cli.StringFlag{
@@ -318,12 +701,102 @@ func main() {
 						Usage: "ollama host",
 						Value: "http://localhost:11434",
 					},
+					&cli.StringFlag{
+						Name:  "openai-base-url",
+						Usage: "base URL of an OpenAI-compatible endpoint, for openai/ models",
+					},
+					&cli.StringFlag{
+						Name:  "config",
+						Usage: "file of settings, one \"key value\" per line as taken by /set (default: ~/.config/layosh/config)",
+					},
+					&cli.FloatFlag{
+						Name:  "temperature",
+						Usage: "sampling temperature, above 0",
+					},
+					&cli.FloatFlag{
+						Name:  "top-p",
+						Usage: "nucleus sampling probability mass, in (0, 1]",
+					},
+					&cli.IntFlag{
+						Name:  "max-tokens",
+						Usage: "maximum number of output tokens",
+					},
+					&cli.StringSliceFlag{
+						Name:  "stop",
+						Usage: "stop sequence, may be repeated",
+					},
+					&cli.IntFlag{
+						Name:  "seed",
+						Usage: "sampling seed, where the provider supports it",
+					},
+					&cli.StringFlag{
+						Name:  "system",
+						Usage: "extra instructions for the model, sent as the system prompt",
+					},
+					&cli.BoolFlag{
+						Name:  "sandbox",
+						Usage: "run the command in a namespace sandbox over a copy-on-write overlay of the current directory",
+					},
+					&cli.BoolFlag{
+						Name:  "sandbox-offline",
+						Usage: "give the sandbox its own network namespace, without network access",
+					},
+					&cli.StringFlag{
+						Name:  "tldr-pages",
+						Usage: "directory of tldr-style pages for offline suggestions",
+					},
+					&cli.StringFlag{
+						Name:  "resize-policy",
+						Usage: "terminal size when clients differ: smallest, or leader (the -leader client, else the first attached)",
+						Value: "smallest",
+					},
+					&cli.StringFlag{
+						Name:  "respawn",
+						Usage: "start the command again when it exits: never, always, or on-failure, with backoff",
+						Value: "never",
+					},
+					&cli.StringFlag{
+						Name:  "prefix",
+						Usage: "prefix key, then d detaches, i interrupts, z stops, t terminates the foreground job",
+						Value: "ctrl-]",
+					},
 				},
 				Action: func(ctx context.Context, c *cli.Command) error {
 					runTmux(executable, c)
 					return nil
 				},
 			},
+			{
+				Name:   "sandbox-init",
+				Usage:  "set up the sandbox and run the command (internal)",
+				Hidden: true,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "lower",
+						Usage: "working tree to overlay",
+					},
+					&cli.StringFlag{
+						Name:  "upper",
+						Usage: "overlay upper directory",
+					},
+					&cli.StringFlag{
+						Name:  "work",
+						Usage: "overlay work directory",
+					},
+					&cli.BoolFlag{
+						Name:  "loopback",
+						Usage: "bring up the loopback interface",
+					},
+					&cli.BoolFlag{
+						Name:  "readonly-root",
+						Usage: "make everything outside the working tree read-only",
+					},
+				},
+				Action: func(ctx context.Context, c *cli.Command) error {
+					runSandboxInit(c)
+					return nil
+				},
+			},
 		},
 	}
 
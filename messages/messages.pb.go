@@ -30,6 +30,10 @@ const (
 	MessageType_ERROR        MessageType = 3
 	MessageType_REGISTERED   MessageType = 4
 	MessageType_RESIZE       MessageType = 5
+	MessageType_PING         MessageType = 6
+	MessageType_PONG         MessageType = 7
+	MessageType_SIGNAL       MessageType = 8
+	MessageType_EXIT         MessageType = 9
 )
 
 // Enum value maps for MessageType.
@@ -41,6 +45,10 @@ var (
 		3: "ERROR",
 		4: "REGISTERED",
 		5: "RESIZE",
+		6: "PING",
+		7: "PONG",
+		8: "SIGNAL",
+		9: "EXIT",
 	}
 	MessageType_value = map[string]int32{
 		"REGISTRATION": 0,
@@ -49,6 +57,10 @@ var (
 		"ERROR":        3,
 		"REGISTERED":   4,
 		"RESIZE":       5,
+		"PING":         6,
+		"PONG":         7,
+		"SIGNAL":       8,
+		"EXIT":         9,
 	}
 )
 
@@ -84,6 +96,8 @@ type Role int32
 const (
 	Role_SHELL Role = 0
 	Role_LLM   Role = 1
+	// receives the output of the role it watches, can't send input
+	Role_OBSERVER Role = 2
 )
 
 // Enum value maps for Role.
@@ -91,10 +105,12 @@ var (
 	Role_name = map[int32]string{
 		0: "SHELL",
 		1: "LLM",
+		2: "OBSERVER",
 	}
 	Role_value = map[string]int32{
-		"SHELL": 0,
-		"LLM":   1,
+		"SHELL":    0,
+		"LLM":      1,
+		"OBSERVER": 2,
 	}
 )
 
@@ -125,6 +141,168 @@ func (Role) EnumDescriptor() ([]byte, []int) {
 	return file_messages_proto_rawDescGZIP(), []int{1}
 }
 
+// optional protocol features, a connection uses those both sides support
+type Capability int32
+
+const (
+	Capability_STREAMING           Capability = 0
+	Capability_FULL_SCREEN_REPAINT Capability = 1
+	Capability_STRUCTURED_EVENTS   Capability = 2
+	Capability_COMPRESSION         Capability = 3
+)
+
+// Enum value maps for Capability.
+var (
+	Capability_name = map[int32]string{
+		0: "STREAMING",
+		1: "FULL_SCREEN_REPAINT",
+		2: "STRUCTURED_EVENTS",
+		3: "COMPRESSION",
+	}
+	Capability_value = map[string]int32{
+		"STREAMING":           0,
+		"FULL_SCREEN_REPAINT": 1,
+		"STRUCTURED_EVENTS":   2,
+		"COMPRESSION":         3,
+	}
+)
+
+func (x Capability) Enum() *Capability {
+	p := new(Capability)
+	*p = x
+	return p
+}
+
+func (x Capability) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (Capability) Descriptor() protoreflect.EnumDescriptor {
+	return file_messages_proto_enumTypes[2].Descriptor()
+}
+
+func (Capability) Type() protoreflect.EnumType {
+	return &file_messages_proto_enumTypes[2]
+}
+
+func (x Capability) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use Capability.Descriptor instead.
+func (Capability) EnumDescriptor() ([]byte, []int) {
+	return file_messages_proto_rawDescGZIP(), []int{2}
+}
+
+// why the server dropped a client
+type ErrorCode int32
+
+const (
+	ErrorCode_ERROR_UNKNOWN              ErrorCode = 0
+	ErrorCode_ERROR_INVALID_REGISTRATION ErrorCode = 1
+	ErrorCode_ERROR_PROTOCOL_MISMATCH    ErrorCode = 2
+	ErrorCode_ERROR_SESSION_MISMATCH     ErrorCode = 3
+	ErrorCode_ERROR_ROLE_TAKEN           ErrorCode = 4
+	ErrorCode_ERROR_UNKNOWN_ROLE         ErrorCode = 5
+)
+
+// Enum value maps for ErrorCode.
+var (
+	ErrorCode_name = map[int32]string{
+		0: "ERROR_UNKNOWN",
+		1: "ERROR_INVALID_REGISTRATION",
+		2: "ERROR_PROTOCOL_MISMATCH",
+		3: "ERROR_SESSION_MISMATCH",
+		4: "ERROR_ROLE_TAKEN",
+		5: "ERROR_UNKNOWN_ROLE",
+	}
+	ErrorCode_value = map[string]int32{
+		"ERROR_UNKNOWN":              0,
+		"ERROR_INVALID_REGISTRATION": 1,
+		"ERROR_PROTOCOL_MISMATCH":    2,
+		"ERROR_SESSION_MISMATCH":     3,
+		"ERROR_ROLE_TAKEN":           4,
+		"ERROR_UNKNOWN_ROLE":         5,
+	}
+)
+
+func (x ErrorCode) Enum() *ErrorCode {
+	p := new(ErrorCode)
+	*p = x
+	return p
+}
+
+func (x ErrorCode) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (ErrorCode) Descriptor() protoreflect.EnumDescriptor {
+	return file_messages_proto_enumTypes[3].Descriptor()
+}
+
+func (ErrorCode) Type() protoreflect.EnumType {
+	return &file_messages_proto_enumTypes[3]
+}
+
+func (x ErrorCode) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use ErrorCode.Descriptor instead.
+func (ErrorCode) EnumDescriptor() ([]byte, []int) {
+	return file_messages_proto_rawDescGZIP(), []int{3}
+}
+
+// signals a client may send to the foreground process group of the shell
+type Signal int32
+
+const (
+	Signal_INTERRUPT Signal = 0
+	Signal_STOP      Signal = 1
+	Signal_TERMINATE Signal = 2
+)
+
+// Enum value maps for Signal.
+var (
+	Signal_name = map[int32]string{
+		0: "INTERRUPT",
+		1: "STOP",
+		2: "TERMINATE",
+	}
+	Signal_value = map[string]int32{
+		"INTERRUPT": 0,
+		"STOP":      1,
+		"TERMINATE": 2,
+	}
+)
+
+func (x Signal) Enum() *Signal {
+	p := new(Signal)
+	*p = x
+	return p
+}
+
+func (x Signal) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (Signal) Descriptor() protoreflect.EnumDescriptor {
+	return file_messages_proto_enumTypes[4].Descriptor()
+}
+
+func (Signal) Type() protoreflect.EnumType {
+	return &file_messages_proto_enumTypes[4]
+}
+
+func (x Signal) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use Signal.Descriptor instead.
+func (Signal) EnumDescriptor() ([]byte, []int) {
+	return file_messages_proto_rawDescGZIP(), []int{4}
+}
+
 type Message struct {
 	state protoimpl.MessageState `protogen:"open.v1"`
 	Type  MessageType            `protobuf:"varint,1,opt,name=type,proto3,enum=MessageType" json:"type,omitempty"`
@@ -136,6 +314,10 @@ type Message struct {
 	//	*Message_Error
 	//	*Message_Registered
 	//	*Message_Resize
+	//	*Message_Ping
+	//	*Message_Pong
+	//	*Message_Signal
+	//	*Message_Exit
 	Message       isMessage_Message `protobuf_oneof:"message"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
@@ -239,6 +421,42 @@ func (x *Message) GetResize() *ResizeMessage {
 	return nil
 }
 
+func (x *Message) GetPing() *PingMessage {
+	if x != nil {
+		if x, ok := x.Message.(*Message_Ping); ok {
+			return x.Ping
+		}
+	}
+	return nil
+}
+
+func (x *Message) GetPong() *PongMessage {
+	if x != nil {
+		if x, ok := x.Message.(*Message_Pong); ok {
+			return x.Pong
+		}
+	}
+	return nil
+}
+
+func (x *Message) GetSignal() *SignalMessage {
+	if x != nil {
+		if x, ok := x.Message.(*Message_Signal); ok {
+			return x.Signal
+		}
+	}
+	return nil
+}
+
+func (x *Message) GetExit() *ExitMessage {
+	if x != nil {
+		if x, ok := x.Message.(*Message_Exit); ok {
+			return x.Exit
+		}
+	}
+	return nil
+}
+
 type isMessage_Message interface {
 	isMessage_Message()
 }
@@ -267,6 +485,22 @@ type Message_Resize struct {
 	Resize *ResizeMessage `protobuf:"bytes,15,opt,name=resize,proto3,oneof"`
 }
 
+type Message_Ping struct {
+	Ping *PingMessage `protobuf:"bytes,16,opt,name=ping,proto3,oneof"`
+}
+
+type Message_Pong struct {
+	Pong *PongMessage `protobuf:"bytes,17,opt,name=pong,proto3,oneof"`
+}
+
+type Message_Signal struct {
+	Signal *SignalMessage `protobuf:"bytes,18,opt,name=signal,proto3,oneof"`
+}
+
+type Message_Exit struct {
+	Exit *ExitMessage `protobuf:"bytes,19,opt,name=exit,proto3,oneof"`
+}
+
 func (*Message_Registration) isMessage_Message() {}
 
 func (*Message_UserInput) isMessage_Message() {}
@@ -279,14 +513,34 @@ func (*Message_Registered) isMessage_Message() {}
 
 func (*Message_Resize) isMessage_Message() {}
 
+func (*Message_Ping) isMessage_Message() {}
+
+func (*Message_Pong) isMessage_Message() {}
+
+func (*Message_Signal) isMessage_Message() {}
+
+func (*Message_Exit) isMessage_Message() {}
+
 type RegistrationMessage struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	SessionId     uint32                 `protobuf:"varint,1,opt,name=session_id,json=sessionId,proto3" json:"session_id,omitempty"`
-	Role          Role                   `protobuf:"varint,2,opt,name=role,proto3,enum=Role" json:"role,omitempty"`
-	Width         uint32                 `protobuf:"varint,3,opt,name=width,proto3" json:"width,omitempty"`
-	Height        uint32                 `protobuf:"varint,4,opt,name=height,proto3" json:"height,omitempty"`
-	unknownFields protoimpl.UnknownFields
-	sizeCache     protoimpl.SizeCache
+	state     protoimpl.MessageState `protogen:"open.v1"`
+	SessionId uint32                 `protobuf:"varint,1,opt,name=session_id,json=sessionId,proto3" json:"session_id,omitempty"`
+	Role      Role                   `protobuf:"varint,2,opt,name=role,proto3,enum=Role" json:"role,omitempty"`
+	Width     uint32                 `protobuf:"varint,3,opt,name=width,proto3" json:"width,omitempty"`
+	Height    uint32                 `protobuf:"varint,4,opt,name=height,proto3" json:"height,omitempty"`
+	// 0 for clients that predate versioning
+	ProtocolVersion uint32       `protobuf:"varint,5,opt,name=protocol_version,json=protocolVersion,proto3" json:"protocol_version,omitempty"`
+	Capabilities    []Capability `protobuf:"varint,6,rep,packed,name=capabilities,proto3,enum=Capability" json:"capabilities,omitempty"`
+	// the pane an OBSERVER watches, SHELL or LLM
+	Watch Role `protobuf:"varint,7,opt,name=watch,proto3,enum=Role" json:"watch,omitempty"`
+	// ask to set the terminal size under the leader resize policy
+	Leader bool `protobuf:"varint,8,opt,name=leader,proto3" json:"leader,omitempty"`
+	// the sequence of the last output received before a disconnect, 0 for a
+	// new client
+	ResumeAfter uint64 `protobuf:"varint,9,opt,name=resume_after,json=resumeAfter,proto3" json:"resume_after,omitempty"`
+	// the largest message the client accepts, 0 from clients that predate it
+	MaxMessageSize uint32 `protobuf:"varint,10,opt,name=max_message_size,json=maxMessageSize,proto3" json:"max_message_size,omitempty"`
+	unknownFields  protoimpl.UnknownFields
+	sizeCache      protoimpl.SizeCache
 }
 
 func (x *RegistrationMessage) Reset() {
@@ -347,11 +601,60 @@ func (x *RegistrationMessage) GetHeight() uint32 {
 	return 0
 }
 
+func (x *RegistrationMessage) GetProtocolVersion() uint32 {
+	if x != nil {
+		return x.ProtocolVersion
+	}
+	return 0
+}
+
+func (x *RegistrationMessage) GetCapabilities() []Capability {
+	if x != nil {
+		return x.Capabilities
+	}
+	return nil
+}
+
+func (x *RegistrationMessage) GetWatch() Role {
+	if x != nil {
+		return x.Watch
+	}
+	return Role_SHELL
+}
+
+func (x *RegistrationMessage) GetLeader() bool {
+	if x != nil {
+		return x.Leader
+	}
+	return false
+}
+
+func (x *RegistrationMessage) GetResumeAfter() uint64 {
+	if x != nil {
+		return x.ResumeAfter
+	}
+	return 0
+}
+
+func (x *RegistrationMessage) GetMaxMessageSize() uint32 {
+	if x != nil {
+		return x.MaxMessageSize
+	}
+	return 0
+}
+
 type RegisteredMessage struct {
-	state          protoimpl.MessageState `protogen:"open.v1"`
-	MaxMessageSize uint32                 `protobuf:"varint,1,opt,name=max_message_size,json=maxMessageSize,proto3" json:"max_message_size,omitempty"`
-	unknownFields  protoimpl.UnknownFields
-	sizeCache      protoimpl.SizeCache
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// the limit both sides keep to, the smaller of theirs
+	MaxMessageSize  uint32 `protobuf:"varint,1,opt,name=max_message_size,json=maxMessageSize,proto3" json:"max_message_size,omitempty"`
+	ProtocolVersion uint32 `protobuf:"varint,2,opt,name=protocol_version,json=protocolVersion,proto3" json:"protocol_version,omitempty"`
+	// the capabilities both sides support
+	Capabilities []Capability `protobuf:"varint,3,rep,packed,name=capabilities,proto3,enum=Capability" json:"capabilities,omitempty"`
+	// the output after resume_after is replayed, otherwise the client gets the
+	// current line only
+	Resumed       bool `protobuf:"varint,4,opt,name=resumed,proto3" json:"resumed,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
 }
 
 func (x *RegisteredMessage) Reset() {
@@ -391,6 +694,27 @@ func (x *RegisteredMessage) GetMaxMessageSize() uint32 {
 	return 0
 }
 
+func (x *RegisteredMessage) GetProtocolVersion() uint32 {
+	if x != nil {
+		return x.ProtocolVersion
+	}
+	return 0
+}
+
+func (x *RegisteredMessage) GetCapabilities() []Capability {
+	if x != nil {
+		return x.Capabilities
+	}
+	return nil
+}
+
+func (x *RegisteredMessage) GetResumed() bool {
+	if x != nil {
+		return x.Resumed
+	}
+	return false
+}
+
 type UserInputMessage struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	Data          []byte                 `protobuf:"bytes,1,opt,name=data,proto3" json:"data,omitempty"`
@@ -436,8 +760,11 @@ func (x *UserInputMessage) GetData() []byte {
 }
 
 type OutputMessage struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	Data          []byte                 `protobuf:"bytes,1,opt,name=data,proto3" json:"data,omitempty"`
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Data  []byte                 `protobuf:"bytes,1,opt,name=data,proto3" json:"data,omitempty"`
+	// increases by one per output message of a pane, output split to fit the
+	// message size has it on the last piece only, 0 on the others
+	Sequence      uint64 `protobuf:"varint,2,opt,name=sequence,proto3" json:"sequence,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -479,9 +806,18 @@ func (x *OutputMessage) GetData() []byte {
 	return nil
 }
 
+func (x *OutputMessage) GetSequence() uint64 {
+	if x != nil {
+		return x.Sequence
+	}
+	return 0
+}
+
 type ErrorMessage struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	Error         string                 `protobuf:"bytes,1,opt,name=error,proto3" json:"error,omitempty"`
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// human-readable reason
+	Error         string    `protobuf:"bytes,1,opt,name=error,proto3" json:"error,omitempty"`
+	Code          ErrorCode `protobuf:"varint,2,opt,name=code,proto3,enum=ErrorCode" json:"code,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -523,6 +859,195 @@ func (x *ErrorMessage) GetError() string {
 	return ""
 }
 
+func (x *ErrorMessage) GetCode() ErrorCode {
+	if x != nil {
+		return x.Code
+	}
+	return ErrorCode_ERROR_UNKNOWN
+}
+
+// sent by clients to keep the connection alive
+type PingMessage struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// the sequence of the last output received
+	Ack           uint64 `protobuf:"varint,1,opt,name=ack,proto3" json:"ack,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *PingMessage) Reset() {
+	*x = PingMessage{}
+	mi := &file_messages_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *PingMessage) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PingMessage) ProtoMessage() {}
+
+func (x *PingMessage) ProtoReflect() protoreflect.Message {
+	mi := &file_messages_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PingMessage.ProtoReflect.Descriptor instead.
+func (*PingMessage) Descriptor() ([]byte, []int) {
+	return file_messages_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *PingMessage) GetAck() uint64 {
+	if x != nil {
+		return x.Ack
+	}
+	return 0
+}
+
+type PongMessage struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *PongMessage) Reset() {
+	*x = PongMessage{}
+	mi := &file_messages_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *PongMessage) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PongMessage) ProtoMessage() {}
+
+func (x *PongMessage) ProtoReflect() protoreflect.Message {
+	mi := &file_messages_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PongMessage.ProtoReflect.Descriptor instead.
+func (*PongMessage) Descriptor() ([]byte, []int) {
+	return file_messages_proto_rawDescGZIP(), []int{7}
+}
+
+type SignalMessage struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Signal        Signal                 `protobuf:"varint,1,opt,name=signal,proto3,enum=Signal" json:"signal,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SignalMessage) Reset() {
+	*x = SignalMessage{}
+	mi := &file_messages_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SignalMessage) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SignalMessage) ProtoMessage() {}
+
+func (x *SignalMessage) ProtoReflect() protoreflect.Message {
+	mi := &file_messages_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SignalMessage.ProtoReflect.Descriptor instead.
+func (*SignalMessage) Descriptor() ([]byte, []int) {
+	return file_messages_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *SignalMessage) GetSignal() Signal {
+	if x != nil {
+		return x.Signal
+	}
+	return Signal_INTERRUPT
+}
+
+// sent to every client when the wrapped command exited, before the server
+// closes the connections
+type ExitMessage struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// the command's exit code, -1 when a signal killed it
+	Code int32 `protobuf:"varint,1,opt,name=code,proto3" json:"code,omitempty"`
+	// the signal that killed the command, e.g. SIGKILL
+	Signal        string `protobuf:"bytes,2,opt,name=signal,proto3" json:"signal,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ExitMessage) Reset() {
+	*x = ExitMessage{}
+	mi := &file_messages_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ExitMessage) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ExitMessage) ProtoMessage() {}
+
+func (x *ExitMessage) ProtoReflect() protoreflect.Message {
+	mi := &file_messages_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ExitMessage.ProtoReflect.Descriptor instead.
+func (*ExitMessage) Descriptor() ([]byte, []int) {
+	return file_messages_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *ExitMessage) GetCode() int32 {
+	if x != nil {
+		return x.Code
+	}
+	return 0
+}
+
+func (x *ExitMessage) GetSignal() string {
+	if x != nil {
+		return x.Signal
+	}
+	return ""
+}
+
 type ResizeMessage struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	Width         uint32                 `protobuf:"varint,1,opt,name=width,proto3" json:"width,omitempty"`
@@ -533,7 +1058,7 @@ type ResizeMessage struct {
 
 func (x *ResizeMessage) Reset() {
 	*x = ResizeMessage{}
-	mi := &file_messages_proto_msgTypes[6]
+	mi := &file_messages_proto_msgTypes[10]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -545,7 +1070,7 @@ func (x *ResizeMessage) String() string {
 func (*ResizeMessage) ProtoMessage() {}
 
 func (x *ResizeMessage) ProtoReflect() protoreflect.Message {
-	mi := &file_messages_proto_msgTypes[6]
+	mi := &file_messages_proto_msgTypes[10]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -558,7 +1083,7 @@ func (x *ResizeMessage) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use ResizeMessage.ProtoReflect.Descriptor instead.
 func (*ResizeMessage) Descriptor() ([]byte, []int) {
-	return file_messages_proto_rawDescGZIP(), []int{6}
+	return file_messages_proto_rawDescGZIP(), []int{10}
 }
 
 func (x *ResizeMessage) GetWidth() uint32 {
@@ -579,7 +1104,7 @@ var File_messages_proto protoreflect.FileDescriptor
 
 const file_messages_proto_rawDesc = "" +
 	"\n" +
-	"\x0emessages.proto\"\xd7\x02\n" +
+	"\x0emessages.proto\"\xed\x03\n" +
 	"\aMessage\x12 \n" +
 	"\x04type\x18\x01 \x01(\x0e2\f.MessageTypeR\x04type\x12:\n" +
 	"\fregistration\x18\n" +
@@ -591,25 +1116,50 @@ const file_messages_proto_rawDesc = "" +
 	"\n" +
 	"registered\x18\x0e \x01(\v2\x12.RegisteredMessageH\x00R\n" +
 	"registered\x12(\n" +
-	"\x06resize\x18\x0f \x01(\v2\x0e.ResizeMessageH\x00R\x06resizeB\t\n" +
-	"\amessage\"}\n" +
+	"\x06resize\x18\x0f \x01(\v2\x0e.ResizeMessageH\x00R\x06resize\x12\"\n" +
+	"\x04ping\x18\x10 \x01(\v2\f.PingMessageH\x00R\x04ping\x12\"\n" +
+	"\x04pong\x18\x11 \x01(\v2\f.PongMessageH\x00R\x04pong\x12(\n" +
+	"\x06signal\x18\x12 \x01(\v2\x0e.SignalMessageH\x00R\x06signal\x12\"\n" +
+	"\x04exit\x18\x13 \x01(\v2\f.ExitMessageH\x00R\x04exitB\t\n" +
+	"\amessage\"\xdb\x02\n" +
 	"\x13RegistrationMessage\x12\x1d\n" +
 	"\n" +
 	"session_id\x18\x01 \x01(\rR\tsessionId\x12\x19\n" +
 	"\x04role\x18\x02 \x01(\x0e2\x05.RoleR\x04role\x12\x14\n" +
 	"\x05width\x18\x03 \x01(\rR\x05width\x12\x16\n" +
-	"\x06height\x18\x04 \x01(\rR\x06height\"=\n" +
+	"\x06height\x18\x04 \x01(\rR\x06height\x12)\n" +
+	"\x10protocol_version\x18\x05 \x01(\rR\x0fprotocolVersion\x12/\n" +
+	"\fcapabilities\x18\x06 \x03(\x0e2\v.CapabilityR\fcapabilities\x12\x1b\n" +
+	"\x05watch\x18\a \x01(\x0e2\x05.RoleR\x05watch\x12\x16\n" +
+	"\x06leader\x18\b \x01(\bR\x06leader\x12!\n" +
+	"\fresume_after\x18\t \x01(\x04R\vresumeAfter\x12(\n" +
+	"\x10max_message_size\x18\n" +
+	" \x01(\rR\x0emaxMessageSize\"\xb3\x01\n" +
 	"\x11RegisteredMessage\x12(\n" +
-	"\x10max_message_size\x18\x01 \x01(\rR\x0emaxMessageSize\"&\n" +
+	"\x10max_message_size\x18\x01 \x01(\rR\x0emaxMessageSize\x12)\n" +
+	"\x10protocol_version\x18\x02 \x01(\rR\x0fprotocolVersion\x12/\n" +
+	"\fcapabilities\x18\x03 \x03(\x0e2\v.CapabilityR\fcapabilities\x12\x18\n" +
+	"\aresumed\x18\x04 \x01(\bR\aresumed\"&\n" +
 	"\x10UserInputMessage\x12\x12\n" +
-	"\x04data\x18\x01 \x01(\fR\x04data\"#\n" +
+	"\x04data\x18\x01 \x01(\fR\x04data\"?\n" +
 	"\rOutputMessage\x12\x12\n" +
-	"\x04data\x18\x01 \x01(\fR\x04data\"$\n" +
+	"\x04data\x18\x01 \x01(\fR\x04data\x12\x1a\n" +
+	"\bsequence\x18\x02 \x01(\x04R\bsequence\"D\n" +
 	"\fErrorMessage\x12\x14\n" +
-	"\x05error\x18\x01 \x01(\tR\x05error\"=\n" +
+	"\x05error\x18\x01 \x01(\tR\x05error\x12\x1e\n" +
+	"\x04code\x18\x02 \x01(\x0e2\n" +
+	".ErrorCodeR\x04code\"\x1f\n" +
+	"\vPingMessage\x12\x10\n" +
+	"\x03ack\x18\x01 \x01(\x04R\x03ack\"\r\n" +
+	"\vPongMessage\"0\n" +
+	"\rSignalMessage\x12\x1f\n" +
+	"\x06signal\x18\x01 \x01(\x0e2\a.SignalR\x06signal\"9\n" +
+	"\vExitMessage\x12\x12\n" +
+	"\x04code\x18\x01 \x01(\x05R\x04code\x12\x16\n" +
+	"\x06signal\x18\x02 \x01(\tR\x06signal\"=\n" +
 	"\rResizeMessage\x12\x14\n" +
 	"\x05width\x18\x01 \x01(\rR\x05width\x12\x16\n" +
-	"\x06height\x18\x02 \x01(\rR\x06height*b\n" +
+	"\x06height\x18\x02 \x01(\rR\x06height*\x8c\x01\n" +
 	"\vMessageType\x12\x10\n" +
 	"\fREGISTRATION\x10\x00\x12\x0e\n" +
 	"\n" +
@@ -620,10 +1170,33 @@ const file_messages_proto_rawDesc = "" +
 	"\n" +
 	"REGISTERED\x10\x04\x12\n" +
 	"\n" +
-	"\x06RESIZE\x10\x05*\x1a\n" +
+	"\x06RESIZE\x10\x05\x12\b\n" +
+	"\x04PING\x10\x06\x12\b\n" +
+	"\x04PONG\x10\a\x12\n" +
+	"\n" +
+	"\x06SIGNAL\x10\b\x12\b\n" +
+	"\x04EXIT\x10\t*(\n" +
 	"\x04Role\x12\t\n" +
 	"\x05SHELL\x10\x00\x12\a\n" +
-	"\x03LLM\x10\x01B\fZ\n" +
+	"\x03LLM\x10\x01\x12\f\n" +
+	"\bOBSERVER\x10\x02*\\\n" +
+	"\n" +
+	"Capability\x12\r\n" +
+	"\tSTREAMING\x10\x00\x12\x17\n" +
+	"\x13FULL_SCREEN_REPAINT\x10\x01\x12\x15\n" +
+	"\x11STRUCTURED_EVENTS\x10\x02\x12\x0f\n" +
+	"\vCOMPRESSION\x10\x03*\xa5\x01\n" +
+	"\tErrorCode\x12\x11\n" +
+	"\rERROR_UNKNOWN\x10\x00\x12\x1e\n" +
+	"\x1aERROR_INVALID_REGISTRATION\x10\x01\x12\x1b\n" +
+	"\x17ERROR_PROTOCOL_MISMATCH\x10\x02\x12\x1a\n" +
+	"\x16ERROR_SESSION_MISMATCH\x10\x03\x12\x14\n" +
+	"\x10ERROR_ROLE_TAKEN\x10\x04\x12\x16\n" +
+	"\x12ERROR_UNKNOWN_ROLE\x10\x05*0\n" +
+	"\x06Signal\x12\r\n" +
+	"\tINTERRUPT\x10\x00\x12\b\n" +
+	"\x04STOP\x10\x01\x12\r\n" +
+	"\tTERMINATE\x10\x02B\fZ\n" +
 	"./messagesb\x06proto3"
 
 var (
@@ -638,33 +1211,49 @@ func file_messages_proto_rawDescGZIP() []byte {
 	return file_messages_proto_rawDescData
 }
 
-var file_messages_proto_enumTypes = make([]protoimpl.EnumInfo, 2)
-var file_messages_proto_msgTypes = make([]protoimpl.MessageInfo, 7)
+var file_messages_proto_enumTypes = make([]protoimpl.EnumInfo, 5)
+var file_messages_proto_msgTypes = make([]protoimpl.MessageInfo, 11)
 var file_messages_proto_goTypes = []any{
 	(MessageType)(0),            // 0: MessageType
 	(Role)(0),                   // 1: Role
-	(*Message)(nil),             // 2: Message
-	(*RegistrationMessage)(nil), // 3: RegistrationMessage
-	(*RegisteredMessage)(nil),   // 4: RegisteredMessage
-	(*UserInputMessage)(nil),    // 5: UserInputMessage
-	(*OutputMessage)(nil),       // 6: OutputMessage
-	(*ErrorMessage)(nil),        // 7: ErrorMessage
-	(*ResizeMessage)(nil),       // 8: ResizeMessage
+	(Capability)(0),             // 2: Capability
+	(ErrorCode)(0),              // 3: ErrorCode
+	(Signal)(0),                 // 4: Signal
+	(*Message)(nil),             // 5: Message
+	(*RegistrationMessage)(nil), // 6: RegistrationMessage
+	(*RegisteredMessage)(nil),   // 7: RegisteredMessage
+	(*UserInputMessage)(nil),    // 8: UserInputMessage
+	(*OutputMessage)(nil),       // 9: OutputMessage
+	(*ErrorMessage)(nil),        // 10: ErrorMessage
+	(*PingMessage)(nil),         // 11: PingMessage
+	(*PongMessage)(nil),         // 12: PongMessage
+	(*SignalMessage)(nil),       // 13: SignalMessage
+	(*ExitMessage)(nil),         // 14: ExitMessage
+	(*ResizeMessage)(nil),       // 15: ResizeMessage
 }
 var file_messages_proto_depIdxs = []int32{
-	0, // 0: Message.type:type_name -> MessageType
-	3, // 1: Message.registration:type_name -> RegistrationMessage
-	5, // 2: Message.user_input:type_name -> UserInputMessage
-	6, // 3: Message.output:type_name -> OutputMessage
-	7, // 4: Message.error:type_name -> ErrorMessage
-	4, // 5: Message.registered:type_name -> RegisteredMessage
-	8, // 6: Message.resize:type_name -> ResizeMessage
-	1, // 7: RegistrationMessage.role:type_name -> Role
-	8, // [8:8] is the sub-list for method output_type
-	8, // [8:8] is the sub-list for method input_type
-	8, // [8:8] is the sub-list for extension type_name
-	8, // [8:8] is the sub-list for extension extendee
-	0, // [0:8] is the sub-list for field type_name
+	0,  // 0: Message.type:type_name -> MessageType
+	6,  // 1: Message.registration:type_name -> RegistrationMessage
+	8,  // 2: Message.user_input:type_name -> UserInputMessage
+	9,  // 3: Message.output:type_name -> OutputMessage
+	10, // 4: Message.error:type_name -> ErrorMessage
+	7,  // 5: Message.registered:type_name -> RegisteredMessage
+	15, // 6: Message.resize:type_name -> ResizeMessage
+	11, // 7: Message.ping:type_name -> PingMessage
+	12, // 8: Message.pong:type_name -> PongMessage
+	13, // 9: Message.signal:type_name -> SignalMessage
+	14, // 10: Message.exit:type_name -> ExitMessage
+	1,  // 11: RegistrationMessage.role:type_name -> Role
+	2,  // 12: RegistrationMessage.capabilities:type_name -> Capability
+	1,  // 13: RegistrationMessage.watch:type_name -> Role
+	2,  // 14: RegisteredMessage.capabilities:type_name -> Capability
+	3,  // 15: ErrorMessage.code:type_name -> ErrorCode
+	4,  // 16: SignalMessage.signal:type_name -> Signal
+	17, // [17:17] is the sub-list for method output_type
+	17, // [17:17] is the sub-list for method input_type
+	17, // [17:17] is the sub-list for extension type_name
+	17, // [17:17] is the sub-list for extension extendee
+	0,  // [0:17] is the sub-list for field type_name
 }
 
 func init() { file_messages_proto_init() }
@@ -679,14 +1268,18 @@ func file_messages_proto_init() {
 		(*Message_Error)(nil),
 		(*Message_Registered)(nil),
 		(*Message_Resize)(nil),
+		(*Message_Ping)(nil),
+		(*Message_Pong)(nil),
+		(*Message_Signal)(nil),
+		(*Message_Exit)(nil),
 	}
 	type x struct{}
 	out := protoimpl.TypeBuilder{
 		File: protoimpl.DescBuilder{
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_messages_proto_rawDesc), len(file_messages_proto_rawDesc)),
-			NumEnums:      2,
-			NumMessages:   7,
+			NumEnums:      5,
+			NumMessages:   11,
 			NumExtensions: 0,
 			NumServices:   0,
 		},
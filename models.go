@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// how long we wait for a provider to list its models
+const MODEL_LIST_TIMEOUT = 3 * time.Second
+
+type ModelCommand struct {
+	// provider/name to switch to, empty to list the models
+	name string
+}
+
+func (c ModelCommand) String() string {
+	return "ModelCommand"
+}
+
+type ollamaTags struct {
+	Models []struct {
+		Name string `json:"name"`
+	} `json:"models"`
+}
+
+// listOllamaModels asks an Ollama server for its local models.
+func listOllamaModels(ctx context.Context, address string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, MODEL_LIST_TIMEOUT)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		strings.TrimRight(address, "/")+"/api/tags", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("ollama returned %s", response.Status)
+	}
+
+	var tags ollamaTags
+
+	if err := json.NewDecoder(response.Body).Decode(&tags); err != nil {
+		return nil, err
+	}
+
+	var names []string
+
+	for _, model := range tags.Models {
+		names = append(names, model.Name)
+	}
+
+	return names, nil
+}
+
+// ollamaAddress returns the Ollama server of the chain's Ollama models, and
+// false when it has none: there's no point in asking a server nobody uses.
+func (l *LLMWrapper) ollamaAddress() (string, bool) {
+	for _, model := range l.models {
+		if model.config.Provider != "ollama" {
+			continue
+		}
+
+		if model.config.OllamaAddress != "" {
+			return model.config.OllamaAddress, true
+		}
+
+		return "http://localhost:11434", true
+	}
+
+	return "", false
+}
+
+func (l *LLMWrapper) describeModels() string {
+	var out strings.Builder
+
+	out.WriteString("Configured models, tried in order:\n")
+
+	for i, model := range l.models {
+		state := ""
+		if model.breaker.state != BreakerClosed {
+			state = fmt.Sprintf(" (%s circuit breaker %s)", model.config.Provider, model.breaker.state)
+		}
+
+		fmt.Fprintf(&out, "%d. %s%s\n", i+1, model.Name(), state)
+	}
+
+	if address, ok := l.ollamaAddress(); ok {
+		available, err := listOllamaModels(l.context, address)
+
+		switch {
+		case err != nil:
+			fmt.Fprintf(&out, "Ollama models at %s: unavailable (%v)\n", address, err)
+		case len(available) == 0:
+			fmt.Fprintf(&out, "Ollama models at %s: none pulled\n", address)
+		default:
+			fmt.Fprintf(&out, "Ollama models at %s:\n", address)
+
+			for _, name := range available {
+				fmt.Fprintf(&out, "- ollama/%s\n", name)
+			}
+		}
+	}
+
+	out.WriteString("Switch with /model <provider/name>\n")
+
+	return out.String()
+}
+
+// switchModel makes name the first model of the chain, keeping the others as
+// fallbacks. Genkit and the flows are rebuilt, the shell and the history are
+// left alone.
+func (l *LLMWrapper) switchModel(name string) error {
+	provider, modelName, err := splitProviderModel(name)
+	if err != nil {
+		return err
+	}
+
+	config := NewModelConfig()
+	config.Provider = provider
+	config.ModelName = modelName
+
+	// the endpoints come from the command line, they're the same for all
+	// models
+	for _, model := range l.models {
+		if model.config.OllamaAddress != "" {
+			config.OllamaAddress = model.config.OllamaAddress
+		}
+
+		if model.config.OpenAIBaseURL != "" {
+			config.OpenAIBaseURL = model.config.OpenAIBaseURL
+		}
+	}
+
+	// the user asked for an Ollama model, so its server is in use now
+	if config.Provider == "ollama" && config.OllamaAddress != "" {
+		available, err := listOllamaModels(l.context, config.OllamaAddress)
+
+		if err == nil && !slices.Contains(available, modelName) && !slices.Contains(available, modelName+":latest") {
+			l.outputToWarning(fmt.Sprintf("%s isn't pulled on the Ollama server", modelName))
+		}
+	}
+
+	configs := []ModelConfig{config}
+
+	for _, model := range l.models {
+		if model.Name() != config.String() {
+			configs = append(configs, model.config)
+		}
+	}
+
+	gk, models, err := MakeGenkitAndModels(configs, l.context)
+	if err != nil {
+		return err
+	}
+
+	warnings, err := l.checkGeneration(models)
+	if err != nil {
+		return err
+	}
+
+	for _, warning := range warnings {
+		l.outputToWarning(warning)
+	}
+
+	for _, model := range models[1:] {
+		for _, old := range l.models {
+			if old.Name() == model.Name() {
+				model.toolsUnsupported = old.toolsUnsupported
+			}
+		}
+	}
+
+	// the breakers keep their state across the switch, except for the
+	// provider the user asked for
+	delete(l.breakers, config.Provider)
+
+	l.useGenkit(gk, models)
+
+	Info("Switched to model %s\n", config.String())
+
+	return nil
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"embed"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// how many examples to offer, they are generic and may miss the point
+const OFFLINE_SUGGESTIONS = 3
+
+// a few pages in the tldr format, for when no model can be reached
+//
+//go:embed tldr/*.md
+var embeddedPages embed.FS
+
+var (
+	tldrPlaceholder = regexp.MustCompile(`\{\{(.*?)\}\}`)
+
+	offlineWord = regexp.MustCompile(`[a-z0-9][a-z0-9+-]*`)
+
+	offlineStopWords = []string{
+		"a", "an", "and", "are", "as", "at", "be", "by", "can", "do", "for", "from", "give", "how", "i",
+		"in", "into", "is", "it", "me", "my", "of", "on", "or", "please", "some", "that", "the", "this",
+		"to", "want", "what", "with", "you",
+	}
+)
+
+// TldrExample is one example command of a tldr page.
+type TldrExample struct {
+	page        string
+	description string
+	command     string
+}
+
+// OfflineSuggester answers requests from tldr-style pages when the model
+// can't.
+type OfflineSuggester struct {
+	// a directory of user-supplied pages, e.g. a checkout of tldr-pages
+	dir string
+
+	examples []TldrExample
+	loaded   bool
+}
+
+func NewOfflineSuggester(dir string) *OfflineSuggester {
+	return &OfflineSuggester{
+		dir: dir,
+	}
+}
+
+func WithTldrPages(dir string) func(*LLMWrapper) {
+	return func(l *LLMWrapper) {
+		l.offline = NewOfflineSuggester(dir)
+	}
+}
+
+// parseTldrPage parses a page in the tldr format: a "# name" title, "> "
+// description lines, then "- description:" lines each followed by a
+// `command` line.
+func parseTldrPage(name string, data string) []TldrExample {
+	var examples []TldrExample
+
+	description := ""
+
+	scanner := bufio.NewScanner(strings.NewReader(data))
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		switch {
+		case strings.HasPrefix(line, "# "):
+			name = strings.TrimSpace(line[2:])
+		case strings.HasPrefix(line, "- "):
+			description = strings.TrimSuffix(strings.TrimSpace(line[2:]), ":")
+		case strings.HasPrefix(line, "`") && strings.HasSuffix(line, "`") && len(line) > 2:
+			examples = append(examples, TldrExample{
+				page:        name,
+				description: description,
+				command:     line[1 : len(line)-1],
+			})
+		}
+	}
+
+	return examples
+}
+
+func (o *OfflineSuggester) load() {
+	if o.loaded {
+		return
+	}
+
+	o.loaded = true
+
+	loadPages := func(fsys fs.FS) {
+		err := fs.WalkDir(fsys, ".", func(path string, entry fs.DirEntry, err error) error {
+			if err != nil || entry.IsDir() || filepath.Ext(path) != ".md" {
+				return err
+			}
+
+			data, err := fs.ReadFile(fsys, path)
+			if err != nil {
+				return err
+			}
+
+			name := strings.TrimSuffix(filepath.Base(path), ".md")
+			o.examples = append(o.examples, parseTldrPage(name, string(data))...)
+
+			return nil
+		})
+
+		if err != nil {
+			Warn("Error loading tldr pages: %v\n", err)
+		}
+	}
+
+	// user pages first, they win ties
+	if o.dir != "" {
+		loadPages(os.DirFS(o.dir))
+	}
+
+	loadPages(embeddedPages)
+
+	Debug("Loaded %d offline examples\n", len(o.examples))
+}
+
+func offlineWords(text string) []string {
+	var words []string
+
+	for _, word := range offlineWord.FindAllString(strings.ToLower(text), -1) {
+		if !slices.Contains(offlineStopWords, word) {
+			words = append(words, word)
+		}
+	}
+
+	return words
+}
+
+// similarWords matches words with a common stem: "archive" and "archiving".
+func similarWords(a string, b string) bool {
+	if a == b {
+		return true
+	}
+
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+
+	return n >= 5 || (n >= 4 && n >= min(len(a), len(b))-1)
+}
+
+// Suggest returns up to n examples that best match request, best first.
+func (o *OfflineSuggester) Suggest(request string, n int) []TldrExample {
+	o.load()
+
+	words := offlineWords(request)
+
+	type scored struct {
+		example TldrExample
+		score   int
+	}
+
+	var candidates []scored
+
+	for _, example := range o.examples {
+		score := 0
+
+		if slices.Contains(words, strings.ToLower(example.page)) {
+			score += 3
+		}
+
+		described := offlineWords(example.description + " " + example.command)
+
+		for _, word := range words {
+			if slices.ContainsFunc(described, func(other string) bool { return similarWords(word, other) }) {
+				score++
+			}
+		}
+
+		if score > 0 {
+			candidates = append(candidates, scored{example, score})
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].score > candidates[j].score
+	})
+
+	var examples []TldrExample
+
+	for _, candidate := range candidates {
+		if len(examples) == n {
+			break
+		}
+
+		examples = append(examples, candidate.example)
+	}
+
+	return examples
+}
+
+// offlineResponse answers request from the tldr pages, after the model
+// failed with err. It returns false when nothing matches.
+func (l *LLMWrapper) offlineResponse(request LLMRequest, err error) (LLMResponse, bool) {
+	examples := l.offline.Suggest(request.request, max(request.alternatives, OFFLINE_SUGGESTIONS))
+
+	if len(examples) == 0 {
+		return LLMResponse{}, false
+	}
+
+	var responses []LLMResponse
+
+	for _, example := range examples {
+		command := tldrPlaceholder.ReplaceAllString(example.command, "$1")
+
+		responses = append(responses, LLMResponse{
+			kind:       ResponseCommand,
+			command:    command,
+			commentary: example.description,
+			source:     fmt.Sprintf("offline, tldr page of %s", example.page),
+
+			// the placeholders need filling in
+			review: true,
+
+			modifiesFiles: modifiesFiles(command),
+		})
+	}
+
+	response := responses[0]
+	response.warnings = []string{fmt.Sprintf("the model is unavailable (%v), these are generic examples", err)}
+	response.alternatives = responses[1:]
+
+	return response, true
+}
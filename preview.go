@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	PREVIEW_TIMEOUT = 30 * time.Second
+
+	// how much of the command's own output we show in a preview
+	PREVIEW_OUTPUT_BYTES = 4 * 1024
+)
+
+// commands that create, change or delete files on their own
+var fileModifyingCommands = map[string]bool{
+	"rm": true, "rmdir": true, "mv": true, "cp": true, "touch": true,
+	"mkdir": true, "ln": true, "chmod": true, "chown": true, "chgrp": true,
+	"truncate": true, "dd": true, "install": true, "patch": true,
+	"shred": true, "rsync": true, "unzip": true, "tee": true,
+}
+
+// subcommands that modify the working tree
+var fileModifyingSubcommands = map[string]map[string]bool{
+	"git": {
+		"checkout": true, "switch": true, "reset": true, "clean": true,
+		"apply": true, "am": true, "merge": true, "rebase": true,
+		"pull": true, "stash": true, "restore": true, "rm": true,
+		"mv": true, "cherry-pick": true, "revert": true, "init": true,
+		"clone": true,
+	},
+	"npm":   {"install": true, "i": true, "ci": true, "uninstall": true, "init": true},
+	"yarn":  {"add": true, "install": true, "remove": true},
+	"cargo": {"new": true, "init": true, "build": true, "add": true},
+	"go":    {"mod": true, "get": true, "build": true, "generate": true},
+}
+
+var (
+	commandSeparator = regexp.MustCompile(`\|\||&&|[;|&\n]`)
+
+	// > or >> to a file, but not 2>&1 or >/dev/null
+	fileRedirection = regexp.MustCompile(`(^|[^<>])>>?\s*([^\s&>]+)`)
+
+	inPlaceEdit = regexp.MustCompile(`^(sed|perl)\b.*\s-[a-zA-Z]*i`)
+
+	tarExtract = regexp.MustCompile(`^tar\s+(-?[a-zA-Z]*x|.*--extract)`)
+)
+
+// modifiesFiles guesses whether running command would create, change or
+// delete files.
+func modifiesFiles(command string) bool {
+	for _, match := range fileRedirection.FindAllStringSubmatch(command, -1) {
+		if match[2] != "/dev/null" {
+			return true
+		}
+	}
+
+	for _, part := range commandSeparator.Split(command, -1) {
+		fields := strings.Fields(part)
+
+		// skip sudo, env and variable assignments
+		for len(fields) > 0 &&
+			(fields[0] == "sudo" || fields[0] == "env" || strings.Contains(fields[0], "=")) {
+			fields = fields[1:]
+		}
+
+		if len(fields) == 0 {
+			continue
+		}
+
+		name := fields[0]
+
+		if fileModifyingCommands[name] {
+			return true
+		}
+
+		if len(fields) > 1 && fileModifyingSubcommands[name][fields[1]] {
+			return true
+		}
+
+		rest := strings.Join(fields, " ")
+
+		if inPlaceEdit.MatchString(rest) || tarExtract.MatchString(rest) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// runPreview runs command in a separate PTY, inside a sandbox overlaying dir
+// with everything else read-only and no network, and describes the files it
+// would create, modify or delete.
+func runPreview(dir string, command string) (string, error) {
+	sandbox, err := NewSandbox(dir, false, true)
+	if err != nil {
+		return "", err
+	}
+
+	defer sandbox.Remove()
+
+	shell := os.Getenv("SHELL")
+	if shell == "" {
+		shell = "/bin/sh"
+	}
+
+	wrapper := NewShellWrapper([]string{shell, "-c", command})
+	wrapper.sandbox = sandbox
+
+	if err := wrapper.Start(); err != nil {
+		return "", err
+	}
+
+	output := newRecentBuffer(PREVIEW_OUTPUT_BYTES)
+	status := "timed out"
+	timeout := time.After(PREVIEW_TIMEOUT)
+
+waitloop:
+	for {
+		select {
+		case msg := <-wrapper.outputChannel:
+			switch msg := msg.(type) {
+			case []byte:
+				output.Write(msg)
+			case ShellExit:
+				status = fmt.Sprintf("exit code %d", msg.ExitCode)
+				break waitloop
+			}
+		case <-timeout:
+			break waitloop
+		}
+	}
+
+	wrapper.Stop()
+
+	diff, err := sandbox.Diff()
+	if err != nil {
+		return "", err
+	}
+
+	var out strings.Builder
+
+	fmt.Fprintf(&out, "Preview of %s in %s (%s)\n", command, dir, status)
+	out.WriteString("Only changes below this directory are shown, everything else was read-only.\n")
+
+	if text := strings.TrimSpace(normalizeTerminalText(output.String())); text != "" {
+		fmt.Fprintf(&out, "Output:\n%s\n", text)
+	}
+
+	out.WriteString("Changes:\n")
+	out.WriteString(diff)
+
+	return out.String(), nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/darfire/layosh/messages"
+	"google.golang.org/protobuf/encoding/protodelim"
+)
+
+const (
+	// bumped on every incompatible change to messages.proto
+	PROTOCOL_VERSION = 2
+
+	// the oldest client version the server still talks to, older clients
+	// don't send heartbeats
+	MIN_PROTOCOL_VERSION = 2
+
+	// the largest message, without its size prefix, this binary accepts;
+	// each connection uses the smaller of the two sides' limits
+	MAX_MESSAGE_SIZE = 1024
+
+	// smaller limits leave no room for data
+	MIN_MESSAGE_SIZE = 128
+
+	// what a message takes besides its data, with room to spare: the type,
+	// the oneof and data headers and a sequence number
+	MESSAGE_OVERHEAD = 32
+
+	// clients ping this often, and either side drops a connection that
+	// stays silent for the timeout
+	HEARTBEAT_INTERVAL = 5 * time.Second
+	HEARTBEAT_TIMEOUT  = 3 * HEARTBEAT_INTERVAL
+
+	// how long clients keep trying to reconnect, with backoff
+	RECONNECT_TIMEOUT    = 30 * time.Second
+	RECONNECT_BASE_DELAY = 250 * time.Millisecond
+	RECONNECT_MAX_DELAY  = 5 * time.Second
+)
+
+// the capabilities this binary implements
+var supportedCapabilities = []messages.Capability{
+	messages.Capability_STREAMING,
+}
+
+// negotiateCapabilities returns the capabilities both sides support.
+func negotiateCapabilities(offered []messages.Capability) []messages.Capability {
+	var common []messages.Capability
+
+	for _, capability := range supportedCapabilities {
+		if slices.Contains(offered, capability) {
+			common = append(common, capability)
+		}
+	}
+
+	return common
+}
+
+// checkProtocol tells whether the server can talk to a client speaking
+// version.
+func checkProtocol(version uint32) error {
+	if version < MIN_PROTOCOL_VERSION || version > PROTOCOL_VERSION {
+		return fmt.Errorf("client speaks protocol version %d, the server supports %d to %d; "+
+			"restart the session after upgrading layosh",
+			version, MIN_PROTOCOL_VERSION, PROTOCOL_VERSION)
+	}
+
+	return nil
+}
+
+// negotiateMessageSize returns the limit for a connection to a client that
+// accepts messages up to limit, 0 for clients that don't say.
+func negotiateMessageSize(limit uint32) (uint32, error) {
+	if limit == 0 {
+		return MAX_MESSAGE_SIZE, nil
+	}
+
+	if limit < MIN_MESSAGE_SIZE {
+		return 0, fmt.Errorf("the client accepts messages of up to %d bytes, the minimum is %d",
+			limit, MIN_MESSAGE_SIZE)
+	}
+
+	return min(limit, MAX_MESSAGE_SIZE), nil
+}
+
+// readMessage reads one message, failing on one larger than limit.
+func readMessage(reader *bufio.Reader, message *messages.Message, limit uint32) error {
+	// protodelim would take 0 for its default of 4 MiB
+	if limit == 0 {
+		return fmt.Errorf("no message size limit")
+	}
+
+	return protodelim.UnmarshalOptions{MaxSize: int64(limit)}.UnmarshalFrom(reader, message)
+}
+
+// chunk splits data into pieces that fit in messages of limit bytes. Empty
+// data is one empty piece.
+func chunk(data []byte, limit uint32) [][]byte {
+	size := int(limit - MESSAGE_OVERHEAD)
+
+	if len(data) <= size {
+		return [][]byte{data}
+	}
+
+	var pieces [][]byte
+
+	for len(data) > 0 {
+		n := min(size, len(data))
+		pieces = append(pieces, data[:n])
+		data = data[n:]
+	}
+
+	return pieces
+}
+
+// splitOutput splits an output message to fit in limit. The pieces before
+// the last aren't numbered, a client that reconnects in between gets the
+// whole output again.
+func splitOutput(message *messages.Message, limit uint32) []*messages.Message {
+	output := message.GetOutput()
+
+	if output == nil || len(output.Data) <= int(limit-MESSAGE_OVERHEAD) {
+		return []*messages.Message{message}
+	}
+
+	pieces := chunk(output.Data, limit)
+
+	split := make([]*messages.Message, len(pieces))
+
+	for i, piece := range pieces {
+		split[i] = outputMessage(piece, 0)
+	}
+
+	split[len(split)-1].GetOutput().Sequence = output.Sequence
+
+	return split
+}
+
+// rejectClient tells a client why the server is dropping it, the caller
+// closes the connection.
+func rejectClient(writer *bufio.Writer, code messages.ErrorCode, format string, args ...interface{}) {
+	text := fmt.Sprintf(format, args...)
+
+	Error("Rejecting client (%v): %s", code, text)
+
+	// the client may not have told us its limit yet, ours will do
+	if len(text) > MAX_MESSAGE_SIZE-MESSAGE_OVERHEAD {
+		text = text[:MAX_MESSAGE_SIZE-MESSAGE_OVERHEAD-3] + "..."
+	}
+
+	message := &messages.Message{
+		Type: messages.MessageType_ERROR,
+		Message: &messages.Message_Error{
+			Error: &messages.ErrorMessage{
+				Error: text,
+				Code:  code,
+			},
+		},
+	}
+
+	if _, err := protodelim.MarshalTo(writer, message); err != nil {
+		Error("Error marshalling error message: %v", err)
+		return
+	}
+
+	if err := writer.Flush(); err != nil {
+		Error("Error flushing data: %v", err)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/darfire/layosh/messages"
+	"google.golang.org/protobuf/encoding/protodelim"
+	"google.golang.org/protobuf/proto"
+)
+
+func FuzzReadMessage(f *testing.F) {
+	for _, size := range []int{0, 1, MIN_MESSAGE_SIZE, MAX_MESSAGE_SIZE, 2 * MAX_MESSAGE_SIZE} {
+		var buffer bytes.Buffer
+
+		protodelim.MarshalTo(&buffer, outputMessage(bytes.Repeat([]byte("a"), size), math.MaxUint64))
+		f.Add(buffer.Bytes(), uint32(MIN_MESSAGE_SIZE))
+		f.Add(buffer.Bytes(), uint32(MAX_MESSAGE_SIZE))
+	}
+
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}, uint32(MAX_MESSAGE_SIZE))
+	f.Add([]byte{0x05, 0x08}, uint32(MIN_MESSAGE_SIZE))
+
+	f.Fuzz(func(t *testing.T, data []byte, limit uint32) {
+		var message messages.Message
+
+		err := readMessage(bufio.NewReader(bytes.NewReader(data)), &message, limit)
+
+		size, n := binary.Uvarint(data)
+
+		if err == nil && (n <= 0 || size > uint64(limit)) {
+			t.Fatalf("read a message of %d bytes with a limit of %d", size, limit)
+		}
+	})
+}
+
+func FuzzSplitOutput(f *testing.F) {
+	for _, size := range []int{0, 1, MIN_MESSAGE_SIZE - MESSAGE_OVERHEAD, MIN_MESSAGE_SIZE, 10 * MAX_MESSAGE_SIZE} {
+		f.Add(bytes.Repeat([]byte{0xff}, size), uint64(math.MaxUint64), uint32(MIN_MESSAGE_SIZE))
+	}
+
+	f.Add([]byte("hello"), uint64(1), uint32(0))
+
+	f.Fuzz(func(t *testing.T, data []byte, sequence uint64, offered uint32) {
+		limit, err := negotiateMessageSize(offered)
+		if err != nil {
+			t.Skip()
+		}
+
+		var buffer bytes.Buffer
+		writer := bufio.NewWriter(&buffer)
+
+		pieces := splitOutput(outputMessage(data, sequence), limit)
+
+		for _, piece := range pieces {
+			if size := proto.Size(piece); size > int(limit) {
+				t.Fatalf("a piece of %d bytes doesn't fit in %d", size, limit)
+			}
+
+			if err := writeMessage(writer, piece); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		reader := bufio.NewReader(&buffer)
+
+		var joined []byte
+
+		for i := range pieces {
+			var message messages.Message
+
+			if err := readMessage(reader, &message, limit); err != nil {
+				t.Fatalf("reading piece %d of %d: %v", i+1, len(pieces), err)
+			}
+
+			output := message.GetOutput()
+
+			if i == len(pieces)-1 && output.Sequence != sequence {
+				t.Fatalf("the last piece has sequence %d, not %d", output.Sequence, sequence)
+			}
+
+			if i < len(pieces)-1 && output.Sequence != 0 {
+				t.Fatalf("piece %d of %d has sequence %d", i+1, len(pieces), output.Sequence)
+			}
+
+			joined = append(joined, output.Data...)
+		}
+
+		if !bytes.Equal(joined, data) {
+			t.Fatalf("got %d bytes back out of %d", len(joined), len(data))
+		}
+	})
+}
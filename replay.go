@@ -0,0 +1,63 @@
+package main
+
+// output kept per pane for clients that reconnect
+const REPLAY_BUFFER_BYTES = 256 * 1024
+
+type replayEntry struct {
+	sequence uint64
+	data     []byte
+}
+
+// ReplayBuffer keeps the most recent output of a pane, numbered, so that a
+// client that lost its connection can pick up where it left off.
+type ReplayBuffer struct {
+	entries []replayEntry
+	bytes   int
+	limit   int
+
+	// the sequence of the last output
+	sequence uint64
+}
+
+func NewReplayBuffer(limit int) *ReplayBuffer {
+	return &ReplayBuffer{
+		limit: limit,
+	}
+}
+
+// Add numbers data and keeps it, dropping the oldest output past the limit.
+func (b *ReplayBuffer) Add(data []byte) uint64 {
+	b.sequence++
+
+	b.entries = append(b.entries, replayEntry{sequence: b.sequence, data: data})
+	b.bytes += len(data)
+
+	drop := 0
+	for b.bytes > b.limit && drop < len(b.entries)-1 {
+		b.bytes -= len(b.entries[drop].data)
+		drop++
+	}
+
+	b.entries = b.entries[drop:]
+
+	return b.sequence
+}
+
+// Since returns the output after sequence, false when some of it was
+// already dropped.
+func (b *ReplayBuffer) Since(sequence uint64) ([]replayEntry, bool) {
+	if sequence > b.sequence {
+		// the server restarted, the client's numbering is from another run
+		return nil, false
+	}
+
+	if sequence == b.sequence {
+		return nil, true
+	}
+
+	if len(b.entries) == 0 || b.entries[0].sequence > sequence+1 {
+		return nil, false
+	}
+
+	return b.entries[sequence+1-b.entries[0].sequence:], true
+}
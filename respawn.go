@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// the first respawn waits this long, each quick failure after that
+	// twice as long
+	RESPAWN_BASE_DELAY = time.Second
+	RESPAWN_MAX_DELAY  = 30 * time.Second
+
+	// a shell that ran for this long starts the backoff over
+	RESPAWN_RESET_AFTER = time.Minute
+)
+
+// RespawnPolicy decides whether the wrapped command is started again when
+// it exits, instead of ending the session.
+type RespawnPolicy int
+
+const (
+	RespawnNever RespawnPolicy = iota
+	RespawnAlways
+	// RespawnOnFailure respawns after a non-zero exit code or a signal.
+	RespawnOnFailure
+)
+
+func (p RespawnPolicy) String() string {
+	switch p {
+	case RespawnNever:
+		return "never"
+	case RespawnAlways:
+		return "always"
+	case RespawnOnFailure:
+		return "on-failure"
+	default:
+		return fmt.Sprintf("RespawnPolicy(%d)", int(p))
+	}
+}
+
+func ParseRespawnPolicy(value string) (RespawnPolicy, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "never":
+		return RespawnNever, nil
+	case "always":
+		return RespawnAlways, nil
+	case "on-failure":
+		return RespawnOnFailure, nil
+	default:
+		return RespawnNever, fmt.Errorf("unknown respawn policy: %s", value)
+	}
+}
+
+func (p RespawnPolicy) respawns(exit ShellExit) bool {
+	switch p {
+	case RespawnAlways:
+		return true
+	case RespawnOnFailure:
+		return exit.ExitCode != 0 || exit.Signal != 0
+	default:
+		return false
+	}
+}
+
+// respawnDelay is the backoff before the attempt-th respawn in a row,
+// counting from 0.
+func respawnDelay(attempt int) time.Duration {
+	return min(RESPAWN_BASE_DELAY<<min(attempt, 16), RESPAWN_MAX_DELAY)
+}
@@ -0,0 +1,525 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Sandbox runs a command in its own user and mount namespaces, with the
+// working tree mounted as a copy-on-write overlay. Everything the command
+// writes under the working tree ends up in the overlay's upper directory,
+// which can be inspected and copied back with Changes and Commit.
+type Sandbox struct {
+	// the directory holding the upper and work directories
+	dir string
+
+	// the working tree being overlaid
+	lower string
+	upper string
+	work  string
+
+	// when false the sandbox gets its own, empty, network namespace
+	network bool
+
+	// make everything outside the working tree read-only
+	readOnlyRoot bool
+}
+
+type ChangeKind int
+
+const (
+	ChangeCreated ChangeKind = iota
+	ChangeModified
+	ChangeDeleted
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case ChangeCreated:
+		return "created"
+	case ChangeModified:
+		return "modified"
+	case ChangeDeleted:
+		return "deleted"
+	default:
+		return fmt.Sprintf("ChangeKind(%d)", int(k))
+	}
+}
+
+type FileChange struct {
+	// relative to the working tree
+	Path string
+	Kind ChangeKind
+}
+
+func NewSandbox(lower string, network bool, readOnlyRoot bool) (*Sandbox, error) {
+	lower, err := filepath.Abs(lower)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := os.MkdirTemp("", "layosh-sandbox-")
+	if err != nil {
+		return nil, err
+	}
+
+	sb := &Sandbox{
+		dir:     dir,
+		lower:   lower,
+		upper:   filepath.Join(dir, "upper"),
+		work:    filepath.Join(dir, "work"),
+		network: network,
+
+		readOnlyRoot: readOnlyRoot,
+	}
+
+	for _, d := range []string{sb.upper, sb.work} {
+		if err := os.Mkdir(d, 0700); err != nil {
+			os.RemoveAll(dir)
+			return nil, err
+		}
+	}
+
+	Info("Created sandbox for %s in %s", lower, dir)
+
+	return sb, nil
+}
+
+// Command returns the command that sets up the overlay inside the new
+// namespaces and then executes command.
+func (sb *Sandbox) Command(command []string) (*exec.Cmd, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{"sandbox-init",
+		"-lower", sb.lower,
+		"-upper", sb.upper,
+		"-work", sb.work}
+
+	if !sb.network {
+		args = append(args, "-loopback")
+	}
+
+	if sb.readOnlyRoot {
+		args = append(args, "-readonly-root")
+	}
+
+	args = append(args, "--")
+	args = append(args, command...)
+
+	c := exec.Command(self, args...)
+	c.Dir = sb.lower
+
+	return c, nil
+}
+
+// ApplyAttrs adds the namespace flags and id mappings to attrs. The current
+// user is mapped to root inside the namespace, which is what allows the
+// init process to mount the overlay.
+func (sb *Sandbox) ApplyAttrs(attrs *syscall.SysProcAttr) {
+	attrs.Cloneflags |= syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS
+
+	if !sb.network {
+		attrs.Cloneflags |= syscall.CLONE_NEWNET
+	}
+
+	attrs.UidMappings = []syscall.SysProcIDMap{
+		{ContainerID: 0, HostID: os.Getuid(), Size: 1},
+	}
+	attrs.GidMappings = []syscall.SysProcIDMap{
+		{ContainerID: 0, HostID: os.Getgid(), Size: 1},
+	}
+	attrs.GidMappingsEnableSetgroups = false
+}
+
+// startSandboxed runs inside the new namespaces: it mounts the overlay over
+// the working tree and replaces itself with the wrapped command.
+func startSandboxed(lower, upper, work string, loopback bool, readOnlyRoot bool, command []string) error {
+	if len(command) == 0 {
+		return fmt.Errorf("expected command to run")
+	}
+
+	err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, "")
+	if err != nil {
+		return fmt.Errorf("making mounts private: %w", err)
+	}
+
+	if readOnlyRoot {
+		if err := makeRootReadOnly(filepath.Dir(upper)); err != nil {
+			return fmt.Errorf("making root read-only: %w", err)
+		}
+	}
+
+	options := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s,userxattr",
+		escapeOverlayPath(lower), escapeOverlayPath(upper), escapeOverlayPath(work))
+
+	err = unix.Mount("overlay", lower, "overlay", 0, options)
+	if err != nil {
+		return fmt.Errorf("mounting overlay on %s: %w", lower, err)
+	}
+
+	// our cwd still points below the mount point
+	if err := os.Chdir(lower); err != nil {
+		return err
+	}
+
+	if loopback {
+		if err := bringUpLoopback(); err != nil {
+			Warn("Could not bring up loopback interface: %v", err)
+		}
+	}
+
+	path, err := exec.LookPath(command[0])
+	if err != nil {
+		return err
+	}
+
+	return syscall.Exec(path, command, os.Environ())
+}
+
+// makeRootReadOnly remounts every mount read-only, except for scratch, which
+// holds the overlay's upper and work directories.
+func makeRootReadOnly(scratch string) error {
+	err := unix.MountSetattr(-1, "/", unix.AT_RECURSIVE,
+		&unix.MountAttr{Attr_set: unix.MOUNT_ATTR_RDONLY})
+	if err != nil {
+		return err
+	}
+
+	err = unix.Mount(scratch, scratch, "", unix.MS_BIND, "")
+	if err != nil {
+		return err
+	}
+
+	return unix.MountSetattr(-1, scratch, 0,
+		&unix.MountAttr{Attr_clr: unix.MOUNT_ATTR_RDONLY})
+}
+
+func escapeOverlayPath(path string) string {
+	r := strings.NewReplacer(`\`, `\\`, `,`, `\,`, `:`, `\:`)
+	return r.Replace(path)
+}
+
+func bringUpLoopback() error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	ifr, err := unix.NewIfreq("lo")
+	if err != nil {
+		return err
+	}
+
+	ifr.SetUint16(unix.IFF_UP | unix.IFF_LOOPBACK | unix.IFF_RUNNING)
+
+	return unix.IoctlIfreq(fd, unix.SIOCSIFFLAGS, ifr)
+}
+
+func isWhiteout(info os.FileInfo) bool {
+	if info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+
+	stat, ok := info.Sys().(*syscall.Stat_t)
+
+	return ok && stat.Rdev == 0
+}
+
+func isOpaque(path string) bool {
+	buf := make([]byte, 1)
+
+	n, err := unix.Lgetxattr(path, "user.overlay.opaque", buf)
+
+	return err == nil && n == 1 && buf[0] == 'y'
+}
+
+// Changes lists the files created, modified or deleted in the sandbox,
+// relative to the working tree as it is now.
+func (sb *Sandbox) Changes() ([]FileChange, error) {
+	var changes []FileChange
+
+	err := filepath.Walk(sb.upper, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(sb.upper, path)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		lowerPath := filepath.Join(sb.lower, rel)
+		lowerInfo, lowerErr := os.Lstat(lowerPath)
+		inLower := lowerErr == nil
+
+		switch {
+		case isWhiteout(info):
+			if inLower {
+				changes = append(changes, FileChange{Path: rel, Kind: ChangeDeleted})
+			}
+		case info.IsDir() && !inLower:
+			changes = append(changes, FileChange{Path: rel, Kind: ChangeCreated})
+		case info.IsDir():
+			if lowerInfo.IsDir() && isOpaque(path) {
+				changes = append(changes, sb.opaqueDeletions(rel)...)
+			}
+		case !inLower:
+			changes = append(changes, FileChange{Path: rel, Kind: ChangeCreated})
+		default:
+			same, err := sameFile(lowerPath, lowerInfo, path, info)
+			if err != nil {
+				return err
+			}
+
+			if !same {
+				changes = append(changes, FileChange{Path: rel, Kind: ChangeModified})
+			}
+		}
+
+		return nil
+	})
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+
+	return changes, err
+}
+
+// opaqueDeletions lists the lower entries hidden by an opaque upper directory.
+func (sb *Sandbox) opaqueDeletions(rel string) []FileChange {
+	var changes []FileChange
+
+	entries, err := os.ReadDir(filepath.Join(sb.lower, rel))
+	if err != nil {
+		return nil
+	}
+
+	for _, entry := range entries {
+		entryRel := filepath.Join(rel, entry.Name())
+
+		if _, err := os.Lstat(filepath.Join(sb.upper, entryRel)); err == nil {
+			continue
+		}
+
+		changes = append(changes, FileChange{Path: entryRel, Kind: ChangeDeleted})
+	}
+
+	return changes
+}
+
+func sameFile(aPath string, aInfo os.FileInfo, bPath string, bInfo os.FileInfo) (bool, error) {
+	if aInfo.Mode() != bInfo.Mode() {
+		return false, nil
+	}
+
+	if aInfo.Mode()&os.ModeSymlink != 0 {
+		a, err := os.Readlink(aPath)
+		if err != nil {
+			return false, err
+		}
+
+		b, err := os.Readlink(bPath)
+		if err != nil {
+			return false, err
+		}
+
+		return a == b, nil
+	}
+
+	if !aInfo.Mode().IsRegular() || aInfo.Size() != bInfo.Size() {
+		return false, nil
+	}
+
+	a, err := os.ReadFile(aPath)
+	if err != nil {
+		return false, err
+	}
+
+	b, err := os.ReadFile(bPath)
+	if err != nil {
+		return false, err
+	}
+
+	return bytes.Equal(a, b), nil
+}
+
+// Diff describes the sandbox changes as a summary followed by unified diffs.
+func (sb *Sandbox) Diff() (string, error) {
+	changes, err := sb.Changes()
+	if err != nil {
+		return "", err
+	}
+
+	return describeChanges(changes, sb.lower, sb.upper), nil
+}
+
+func describeChanges(changes []FileChange, lower string, upper string) string {
+	if len(changes) == 0 {
+		return "No changes\n"
+	}
+
+	var out strings.Builder
+
+	for _, change := range changes {
+		fmt.Fprintf(&out, "%-8s %s\n", change.Kind, change.Path)
+	}
+
+	for _, change := range changes {
+		out.WriteString(unifiedDiff(change, lower, upper))
+	}
+
+	return out.String()
+}
+
+// unifiedDiff shells out to diff(1), there's no diff in the standard library.
+func unifiedDiff(change FileChange, lower string, upper string) string {
+	before := filepath.Join(lower, change.Path)
+	after := filepath.Join(upper, change.Path)
+
+	switch change.Kind {
+	case ChangeCreated:
+		before = os.DevNull
+	case ChangeDeleted:
+		after = os.DevNull
+	}
+
+	for _, path := range []string{before, after} {
+		if info, err := os.Stat(path); err == nil && info.IsDir() {
+			return ""
+		}
+	}
+
+	c := exec.Command("diff", "-u",
+		"--label", "a/"+change.Path, "--label", "b/"+change.Path,
+		before, after)
+
+	out, err := c.Output()
+
+	// diff exits with 1 when the files differ
+	if exitErr, ok := err.(*exec.ExitError); err != nil && (!ok || exitErr.ExitCode() != 1) {
+		return fmt.Sprintf("(no diff for %s: %v)\n", change.Path, err)
+	}
+
+	return string(out)
+}
+
+// Commit copies the sandbox changes back into the working tree and empties
+// the overlay, which then has nothing over the working tree. The overlay
+// must not be mounted: stop the sandboxed command first.
+func (sb *Sandbox) Commit() ([]FileChange, error) {
+	changes, err := sb.Changes()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, change := range changes {
+		target := filepath.Join(sb.lower, change.Path)
+
+		if change.Kind == ChangeDeleted {
+			err = os.RemoveAll(target)
+		} else {
+			err = copyPath(filepath.Join(sb.upper, change.Path), target)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", change.Path, err)
+		}
+	}
+
+	if err := sb.clear(); err != nil {
+		return nil, fmt.Errorf("emptying the overlay: %w", err)
+	}
+
+	return changes, nil
+}
+
+// clear empties the upper and work directories.
+func (sb *Sandbox) clear() error {
+	// the work directory may hold a root-owned (inside the namespace) subdir
+	os.Chmod(filepath.Join(sb.work, "work"), 0700)
+
+	for _, d := range []string{sb.upper, sb.work} {
+		if err := os.RemoveAll(d); err != nil {
+			return err
+		}
+
+		if err := os.Mkdir(d, 0700); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func copyPath(src string, dst string) error {
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	switch {
+	case info.IsDir():
+		return os.MkdirAll(dst, info.Mode().Perm())
+	case info.Mode()&os.ModeSymlink != 0:
+		link, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+
+		os.RemoveAll(dst)
+
+		return os.Symlink(link, dst)
+	case !info.Mode().IsRegular():
+		return fmt.Errorf("unsupported file type %v", info.Mode().Type())
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	return os.Chmod(dst, info.Mode().Perm())
+}
+
+func (sb *Sandbox) Remove() {
+	if sb == nil {
+		return
+	}
+
+	// the work directory may hold a root-owned (inside the namespace) subdir
+	os.Chmod(filepath.Join(sb.work, "work"), 0700)
+	os.RemoveAll(sb.dir)
+}
@@ -0,0 +1,49 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"syscall"
+)
+
+// Sandbox needs Linux namespaces and overlayfs, see sandbox_linux.go.
+type Sandbox struct{}
+
+type ChangeKind int
+
+type FileChange struct {
+	Path string
+	Kind ChangeKind
+}
+
+var errSandboxUnsupported = fmt.Errorf("sandboxing is only supported on Linux")
+
+func NewSandbox(lower string, network bool, readOnlyRoot bool) (*Sandbox, error) {
+	return nil, errSandboxUnsupported
+}
+
+func (sb *Sandbox) Command(command []string) (*exec.Cmd, error) {
+	return nil, errSandboxUnsupported
+}
+
+func (sb *Sandbox) ApplyAttrs(attrs *syscall.SysProcAttr) {}
+
+func startSandboxed(lower, upper, work string, loopback bool, readOnlyRoot bool, command []string) error {
+	return errSandboxUnsupported
+}
+
+func (sb *Sandbox) Changes() ([]FileChange, error) {
+	return nil, errSandboxUnsupported
+}
+
+func (sb *Sandbox) Diff() (string, error) {
+	return "", errSandboxUnsupported
+}
+
+func (sb *Sandbox) Commit() ([]FileChange, error) {
+	return nil, errSandboxUnsupported
+}
+
+func (sb *Sandbox) Remove() {}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// SanitizePolicy controls what happens to terminal control sequences found
+// in model-generated text before it is written to the LLM client.
+type SanitizePolicy int
+
+const (
+	// SanitizeStrip removes control sequences entirely.
+	SanitizeStrip SanitizePolicy = iota
+	// SanitizeEscape renders control characters visibly, e.g. ESC as ^[.
+	SanitizeEscape
+	// SanitizeOff passes model output through untouched.
+	SanitizeOff
+)
+
+func (p SanitizePolicy) String() string {
+	switch p {
+	case SanitizeStrip:
+		return "strip"
+	case SanitizeEscape:
+		return "escape"
+	case SanitizeOff:
+		return "off"
+	default:
+		return fmt.Sprintf("SanitizePolicy(%d)", int(p))
+	}
+}
+
+func ParseSanitizePolicy(value string) (SanitizePolicy, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "strip":
+		return SanitizeStrip, nil
+	case "escape":
+		return SanitizeEscape, nil
+	case "off", "none":
+		return SanitizeOff, nil
+	default:
+		return SanitizeStrip, fmt.Errorf("unknown sanitize policy: %s", value)
+	}
+}
+
+// sanitizeTerminalText neutralises escape sequences (CSI, OSC, DCS, ...) and
+// other control characters in s according to policy. Tabs and newlines are
+// always kept; carriage returns are kept so callers can still use \r\n.
+func sanitizeTerminalText(s string, policy SanitizePolicy) string {
+	if policy == SanitizeOff {
+		return s
+	}
+
+	var out strings.Builder
+
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+
+		if r == utf8.RuneError && size == 1 {
+			// stray bytes could be read as 8-bit C1 controls by some terminals
+			out.WriteRune(utf8.RuneError)
+			i++
+			continue
+		}
+
+		if !isControlRune(r) {
+			out.WriteString(s[i : i+size])
+			i += size
+			continue
+		}
+
+		if policy == SanitizeEscape {
+			out.WriteString(caretNotation(r))
+			i += size
+			continue
+		}
+
+		i += size
+
+		switch r {
+		case '\x1b':
+			i = skipEscapeSequence(s, i)
+		case '\u009b':
+			i = skipCSI(s, i)
+		case '\u009d', '\u0090', '\u0098', '\u009e', '\u009f':
+			i = skipString(s, i)
+		}
+	}
+
+	return out.String()
+}
+
+func isControlRune(r rune) bool {
+	switch r {
+	case '\t', '\n', '\r':
+		return false
+	}
+
+	return r < 0x20 || r == 0x7f || (r >= 0x80 && r <= 0x9f)
+}
+
+func caretNotation(r rune) string {
+	switch {
+	case r < 0x20:
+		return "^" + string(rune(r+'@'))
+	case r == 0x7f:
+		return "^?"
+	default:
+		return fmt.Sprintf("\\u%04x", r)
+	}
+}
+
+// skipEscapeSequence returns the index just past the escape sequence whose
+// ESC byte ends right before i.
+func skipEscapeSequence(s string, i int) int {
+	if i >= len(s) {
+		return i
+	}
+
+	switch s[i] {
+	case '[':
+		return skipCSI(s, i+1)
+	case ']', 'P', 'X', '^', '_':
+		return skipString(s, i+1)
+	}
+
+	// intermediate bytes followed by a single final byte
+	for i < len(s) && s[i] >= 0x20 && s[i] <= 0x2f {
+		i++
+	}
+
+	if i < len(s) {
+		i++
+	}
+
+	return i
+}
+
+// skipCSI skips parameter and intermediate bytes up to and including the
+// final byte of a control sequence.
+func skipCSI(s string, i int) int {
+	for i < len(s) {
+		c := s[i]
+		i++
+
+		if c >= 0x40 && c <= 0x7e {
+			break
+		}
+	}
+
+	return i
+}
+
+// skipString skips an OSC/DCS/SOS/PM/APC payload, terminated by BEL or ST.
+func skipString(s string, i int) int {
+	for i < len(s) {
+		switch {
+		case s[i] == '\x07':
+			return i + 1
+		case s[i] == '\x1b' && i+1 < len(s) && s[i+1] == '\\':
+			return i + 2
+		case strings.HasPrefix(s[i:], "\u009c"):
+			return i + len("\u009c")
+		}
+
+		i++
+	}
+
+	return i
+}
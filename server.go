@@ -2,17 +2,21 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"net"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"slices"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/darfire/layosh/messages"
 
-	"google.golang.org/protobuf/encoding/protodelim"
+	"golang.org/x/sys/unix"
 	"google.golang.org/protobuf/proto"
 )
 
@@ -20,22 +24,57 @@ type Server struct {
 	command      []string
 	listenSocket net.Listener
 
-	shellSocket net.Conn
-	llmSocket   net.Conn
-
-	shellWriter *bufio.Writer
-	llmWriter   *bufio.Writer
+	// the attached shell, LLM and observer clients
+	clients *ClientRegistry
 
 	sessionId uint32
 
 	shellWrapper *ShellWrapper
 	llmWrapper   *LLMWrapper
 
-	shellChannel chan interface{}
-	llmChannel   chan interface{}
+	// shellWrapper for the LLM wrapper's goroutine, the loop replaces it
+	// when the shell restarts
+	currentShell atomic.Pointer[ShellWrapper]
+
+	respawn RespawnPolicy
+
+	// respawns since the shell last ran for a while
+	respawnAttempt int
+	shellStarted   time.Time
+
+	// fires when the shell is due to respawn, nil otherwise
+	respawnTimer <-chan time.Time
+
+	// what the connection goroutines ask of the server loop
+	events chan ServerEvent
+
+	// closed when the server loop is done, events aren't taken any more
+	stopped chan struct{}
+
+	sandbox *Sandbox
+
+	// most recent last
+	checkpoints []*Checkpoint
+
+	// a checkpoint is being taken off the loop, the suggestions that come
+	// meanwhile wait in checkpointQueue
+	checkpointing   bool
+	checkpointQueue []LLMResponse
+
+	// the working trees that have a snapshot index of this session
+	checkpointRoots map[string]bool
+
+	commandLog *CommandLog
+
+	// the completion marker of a reviewed agent step, typed once the user
+	// runs the step
+	pendingMarker string
+
+	// applied to the LLM wrapper when it's created
+	llmOptions []func(*LLMWrapper)
 
-	lastShellLine []byte
-	lastLLMLine   []byte
+	// how the wrapped command exited, nil while it runs
+	exit *ShellExit
 
 	isClosed bool
 }
@@ -45,7 +84,7 @@ type Size struct {
 	Height uint32
 }
 
-func NewServer(modelConfig ModelConfig, command []string, sessionId int) (*Server, error) {
+func NewServer(modelConfigs []ModelConfig, command []string, sessionId int, options ...func(*Server)) (*Server, error) {
 	if sessionId == -1 {
 		sessionId = os.Getpid()
 	}
@@ -76,26 +115,64 @@ func NewServer(modelConfig ModelConfig, command []string, sessionId int) (*Serve
 		return nil, err
 	}
 
-	llmWrapper, err := NewLLMWrapper(modelConfig, WithCommand(command))
+	shellWrapper := NewShellWrapper(command)
 
-	if err != nil {
-		return nil, err
-	}
+	events := make(chan ServerEvent, EVENT_QUEUE_SIZE)
 
-	return &Server{
+	s := &Server{
 		command:      command,
 		listenSocket: listenSocket,
 		sessionId:    uint32(sessionId),
 
-		shellSocket: nil,
-		llmSocket:   nil,
+		clients: NewClientRegistry(ResizeSmallest, events),
+
+		shellWrapper: shellWrapper,
+
+		events:  events,
+		stopped: make(chan struct{}),
+
+		commandLog: NewCommandLog(),
+	}
+
+	for _, option := range options {
+		option(s)
+	}
+
+	s.shellWrapper.sandbox = s.sandbox
+	s.currentShell.Store(shellWrapper)
+
+	s.llmWrapper, err = NewLLMWrapper(modelConfigs, append([]func(*LLMWrapper){
+		WithCommand(command), WithWorkingDir(s.shellWorkingDir)}, s.llmOptions...)...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
 
-		shellWrapper: NewShellWrapper(command),
-		llmWrapper:   llmWrapper,
+func WithLLMOptions(options ...func(*LLMWrapper)) func(*Server) {
+	return func(s *Server) {
+		s.llmOptions = append(s.llmOptions, options...)
+	}
+}
 
-		shellChannel: make(chan interface{}),
-		llmChannel:   make(chan interface{}),
-	}, nil
+func WithResizePolicy(policy ResizePolicy) func(*Server) {
+	return func(s *Server) {
+		s.clients.policy = policy
+	}
+}
+
+func WithRespawnPolicy(policy RespawnPolicy) func(*Server) {
+	return func(s *Server) {
+		s.respawn = policy
+	}
+}
+
+func WithSandbox(sandbox *Sandbox) func(*Server) {
+	return func(s *Server) {
+		s.sandbox = sandbox
+	}
 }
 
 func (s *Server) Start() {
@@ -103,7 +180,13 @@ func (s *Server) Start() {
 
 	connectionChannel := make(chan net.Conn)
 
-	s.shellWrapper.Start()
+	if err := s.shellWrapper.Start(); err != nil {
+		Error("Error starting shell: %v", err)
+		return
+	}
+
+	s.shellStarted = time.Now()
+
 	s.llmWrapper.Start()
 
 	signal.Reset(os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
@@ -112,7 +195,7 @@ func (s *Server) Start() {
 		for {
 			conn, err := s.listenSocket.Accept()
 
-			if err == net.ErrClosed {
+			if errors.Is(err, net.ErrClosed) {
 				Info("Listener closed")
 				break
 			}
@@ -142,10 +225,11 @@ func (s *Server) Start() {
 			s.handleShellOutput(msg)
 		case msg := <-s.llmWrapper.outputChannel:
 			s.handleLLMOutput(msg)
-		case data := <-s.shellChannel:
-			s.handleShellInput(data)
-		case data := <-s.llmChannel:
-			s.handleLLMInput(data)
+		case event := <-s.events:
+			s.handleEvent(event)
+		case <-s.respawnTimer:
+			s.respawnTimer = nil
+			s.restartShell()
 		case sig := <-sigChannel:
 			Debug("Received signal: %v", sig)
 			return
@@ -158,14 +242,109 @@ func (s *Server) Start() {
 func (s *Server) handleShellOutput(msg interface{}) {
 	switch msg.(type) {
 	case ShellExit:
-		exit := msg.(ShellExit)
-		s.outputToShell([]byte(fmt.Sprintf("Shell exited with code %d\r\n", exit.ExitCode)))
-		s.isClosed = true
+		s.shellExited(msg.(ShellExit))
 	case []byte:
 		data := msg.([]byte)
 		Debug("Received shell output: %d bytes", len(data))
 		s.outputToShell(data)
 		s.llmWrapper.AddShellOutput(data)
+
+		for _, result := range s.commandLog.Feed(data) {
+			s.llmWrapper.AddCommandResult(result)
+		}
+	}
+}
+
+// shellExited ends the session, unless the respawn policy starts the shell
+// again.
+func (s *Server) shellExited(exit ShellExit) {
+	s.outputToShell([]byte(fmt.Sprintf("Shell %v\r\n", exit)))
+
+	s.abandonCommands("the shell exited")
+
+	if !s.respawn.respawns(exit) {
+		s.exit = &exit
+		s.isClosed = true
+		return
+	}
+
+	if time.Since(s.shellStarted) > RESPAWN_RESET_AFTER {
+		s.respawnAttempt = 0
+	}
+
+	delay := respawnDelay(s.respawnAttempt)
+	s.respawnAttempt++
+
+	Info("Respawning the shell in %v (attempt %d)", delay, s.respawnAttempt)
+
+	s.outputToShell([]byte(fmt.Sprintf("\x1b[33m[layosh: restarting the shell in %v]\x1b[0m\r\n", delay)))
+
+	s.respawnTimer = time.After(delay)
+}
+
+// restartShell replaces the shell with a fresh one, running the same
+// command in a new pty. The clients and the LLM conversation stay.
+func (s *Server) restartShell() error {
+	s.shellWrapper.Stop()
+
+	return s.startShell()
+}
+
+// startShell starts a fresh shell after the last one stopped.
+func (s *Server) startShell() error {
+	s.abandonCommands("the shell restarted")
+	s.pendingMarker = ""
+
+	shellWrapper := NewShellWrapper(s.command)
+	shellWrapper.sandbox = s.sandbox
+
+	s.shellWrapper = shellWrapper
+	s.currentShell.Store(shellWrapper)
+
+	s.shellStarted = time.Now()
+
+	if err := shellWrapper.Start(); err != nil {
+		Error("Error restarting shell: %v", err)
+		s.outputToShell([]byte(fmt.Sprintf("Error restarting shell: %v\r\n", err)))
+
+		// nothing will report its exit, the policy decides what's next
+		s.shellExited(ShellExit{ExitCode: 1})
+		return err
+	}
+
+	Info("Restarted the shell")
+
+	size, ok := s.clients.Size(messages.Role_SHELL)
+	s.resizePane(messages.Role_SHELL, size, ok)
+
+	return nil
+}
+
+// abandonCommands tells the LLM wrapper that the commands it's waiting for,
+// e.g. agent steps, won't finish.
+func (s *Server) abandonCommands(reason string) {
+	for _, result := range s.commandLog.Abandon("[" + reason + "]") {
+		s.llmWrapper.AddCommandResult(result)
+	}
+}
+
+// shellWorkingDir is safe to call from the LLM wrapper's goroutine.
+func (s *Server) shellWorkingDir() (string, error) {
+	return s.currentShell.Load().WorkingDir()
+}
+
+func exitMessage(exit ShellExit) *messages.Message {
+	message := &messages.ExitMessage{
+		Code: int32(exit.ExitCode),
+	}
+
+	if exit.Signal != 0 {
+		message.Signal = unix.SignalName(exit.Signal)
+	}
+
+	return &messages.Message{
+		Type:    messages.MessageType_EXIT,
+		Message: &messages.Message_Exit{Exit: message},
 	}
 }
 
@@ -178,77 +357,228 @@ func (s *Server) handleLLMOutput(msg interface{}) {
 		Debug("Received LLM output as bytes: %d bytes", len(msg.([]byte)))
 		s.outputToLLM(msg.([]byte))
 	case LLMResponse:
-		response := msg.(LLMResponse)
-		s.shellWrapper.PushInput([]byte(response.command + "\r\n"))
-		s.outputToLLM([]byte("\r" + response.describe()))
-		s.llmWrapper.AddLLMInput([]byte("\r\n"))
+		s.handleResponse(msg.(LLMResponse))
 	case QuitCommand:
 		s.isClosed = true
+	case SandboxCommand:
+		s.handleSandboxCommand(msg.(SandboxCommand))
+	case UndoCommand:
+		s.handleUndo()
+	case RestartShellCommand:
+		// the user's restart doesn't wait for the backoff
+		s.respawnTimer = nil
+		s.respawnAttempt = 0
+
+		if err := s.restartShell(); err != nil {
+			s.outputToLLM([]byte(fmt.Sprintf("\rError restarting the shell: %v\r\n", err)))
+		} else {
+			s.outputToLLM([]byte("\rRestarted the shell\r\n"))
+		}
+
+		s.llmWrapper.AddLLMInput([]byte("\r\n"))
 	}
 }
 
-func (s *Server) handleShellInput(msg interface{}) {
-	switch msg.(type) {
-	case []byte:
-		data := msg.([]byte)
-		Debug("Received shell input: %d bytes", len(data))
-		s.llmWrapper.AddShellInput(data)
-		s.shellWrapper.PushInput(data)
-	case Size:
-		size := msg.(Size)
-		Debug("Received shell resize: %d x %d", size.Width, size.Height)
-		s.shellWrapper.ResizeTerminal(size.Width, size.Height)
+// handleResponse injects a suggestion into the shell, once its checkpoint is
+// taken. Suggestions are injected in the order they came.
+func (s *Server) handleResponse(response LLMResponse) {
+	if s.checkpointing {
+		s.checkpointQueue = append(s.checkpointQueue, response)
+		return
 	}
+
+	if response.checkpoint && s.checkpoint(response) {
+		return
+	}
+
+	s.injectResponse(response)
 }
 
-func (s *Server) handleLLMInput(msg interface{}) {
-	switch msg.(type) {
-	case []byte:
-		data := msg.([]byte)
-		Debug("Received LLM input: %d bytes", len(data))
-		s.llmWrapper.AddLLMInput(data)
-	case Size:
-		size := msg.(Size)
-		Debug("Received LLM resize: %d x %d", size.Width, size.Height)
-		s.llmWrapper.ResizeTerminal(size.Width, size.Height)
+func (s *Server) injectResponse(response LLMResponse) {
+	command := response.command
+	if response.stepId != "" {
+		s.commandLog.Start(response.stepId, command)
+
+		// the marker would run the command before it's reviewed, it
+		// follows the user's Enter instead
+		if response.review {
+			command = trimCommand(command)
+			s.pendingMarker = completionMarkerCommand(response.stepId)
+		} else {
+			command = withCompletionMarker(command, response.stepId)
+		}
+	}
+	if response.review {
+		s.shellWrapper.PushInput([]byte(command))
+	} else {
+		s.shellWrapper.PushInput([]byte(command + "\r\n"))
 	}
+	s.outputToLLM([]byte("\r" + response.describe()))
+	s.llmWrapper.AddLLMInput([]byte("\r\n"))
 }
 
-func (s *Server) outputToConn(data []byte, writer *bufio.Writer) {
-	if writer == nil {
-		return
+// checkpoint starts snapshotting the shell's git working tree, if any, before
+// response is injected. Hashing a large tree takes a while, so it runs off
+// the loop and the response waits for a CheckpointEvent; checkpoint returns
+// false when there's nothing to wait for. Sandboxed sessions have their own
+// way of rolling back.
+func (s *Server) checkpoint(response LLMResponse) bool {
+	if s.sandbox != nil {
+		return false
 	}
 
-	message := &messages.Message{
-		Type: messages.MessageType_OUTPUT,
-		Message: &messages.Message_Output{
-			Output: &messages.OutputMessage{
-				Data: data,
-			},
-		},
+	dir, err := s.shellWrapper.WorkingDir()
+	if err != nil {
+		Warn("Not creating a checkpoint: %v", err)
+		return false
+	}
+
+	s.checkpointing = true
+
+	go func() {
+		checkpoint, err := CreateCheckpoint(dir, response.command, s.sessionId)
+		s.post(CheckpointEvent{response: response, checkpoint: checkpoint, err: err})
+	}()
+
+	return true
+}
+
+// checkpointDone keeps the checkpoint, injects the suggestion that waited for
+// it, then the ones that came in the meantime.
+func (s *Server) checkpointDone(event CheckpointEvent) {
+	s.checkpointing = false
+
+	s.addCheckpoint(event.checkpoint, event.err)
+	s.injectResponse(event.response)
+
+	queue := s.checkpointQueue
+	s.checkpointQueue = nil
+
+	for _, response := range queue {
+		s.handleResponse(response)
 	}
+}
 
-	_, err := protodelim.MarshalTo(writer, message)
+func (s *Server) addCheckpoint(checkpoint *Checkpoint, err error) {
 	if err != nil {
-		Error("Error marshalling message: %v", err)
+		Error("Error creating checkpoint: %v", err)
+		s.outputToLLM([]byte("\r\x1b[33mWarning: could not create a checkpoint, /undo won't cover this command\r\n\x1b[0m"))
 		return
 	}
 
-	err = writer.Flush()
-	if err != nil {
-		Error("Error flushing data: %v", err)
+	if checkpoint == nil {
+		return
+	}
+
+	if s.checkpointRoots == nil {
+		s.checkpointRoots = map[string]bool{}
+	}
+
+	s.checkpointRoots[checkpoint.root] = true
+
+	s.checkpoints = append(s.checkpoints, checkpoint)
+
+	if len(s.checkpoints) > MAX_CHECKPOINTS {
+		s.checkpoints = s.checkpoints[len(s.checkpoints)-MAX_CHECKPOINTS:]
+	}
+}
+
+func (s *Server) handleUndo() {
+	var output string
+
+	if s.checkpointing {
+		output = "A checkpoint is being taken, /undo again once the command is in the shell\n"
+	} else if len(s.checkpoints) == 0 {
+		output = "Nothing to undo\n"
+	} else {
+		checkpoint := s.checkpoints[len(s.checkpoints)-1]
+
+		if err := checkpoint.Restore(); err != nil {
+			output = fmt.Sprintf("Error restoring checkpoint %v: %v\n", checkpoint, err)
+		} else {
+			s.checkpoints = s.checkpoints[:len(s.checkpoints)-1]
+			output = fmt.Sprintf("Restored checkpoint %v\n", checkpoint)
+		}
+	}
+
+	// the checkpoint carries the model's command
+	output = sanitizeTerminalText(output, SanitizeStrip)
+
+	s.outputToLLM([]byte("\r" + adjustNewlines(output)))
+	s.llmWrapper.AddLLMInput([]byte("\r\n"))
+}
+
+func (s *Server) handleSandboxCommand(cmd SandboxCommand) {
+	if s.sandbox == nil {
+		s.outputToLLM([]byte("\rNot running in a sandbox, start the server with -sandbox\r\n"))
+		return
+	}
+
+	var output string
+
+	switch cmd.action {
+	case "", "diff":
+		diff, err := s.sandbox.Diff()
+		if err != nil {
+			output = fmt.Sprintf("Error computing sandbox diff: %v\n", err)
+		} else {
+			output = diff
+		}
+	case "commit":
+		// overlayfs doesn't allow changing its directories while it's
+		// mounted, and the mount lives as long as the shell's processes
+		s.shellWrapper.Stop()
+
+		changes, err := s.sandbox.Commit()
+		if err != nil {
+			output = fmt.Sprintf("Error committing sandbox changes: %v\n", err)
+		} else {
+			output = fmt.Sprintf("Copied %d changes back to the working tree\n", len(changes))
+		}
+
+		if err := s.startShell(); err != nil {
+			output += fmt.Sprintf("Error restarting the shell: %v\n", err)
+		} else {
+			output += "Restarted the shell on the updated working tree\n"
+		}
+	default:
+		output = fmt.Sprintf("Unknown sandbox action: %s\n", cmd.action)
+	}
+
+	s.outputToLLM([]byte("\r" + adjustNewlines(output)))
+	s.llmWrapper.AddLLMInput([]byte("\r\n"))
+}
+
+func (s *Server) handleShellInput(data []byte) {
+	Debug("Received shell input: %d bytes", len(data))
+	s.llmWrapper.AddShellInput(data)
+	s.shellWrapper.PushInput(data)
+
+	if s.pendingMarker == "" {
 		return
 	}
+
+	// Ctrl-C drops the reviewed command, Enter runs it: the marker line
+	// waits in the pty until the command finishes
+	if bytes.IndexByte(data, '\x03') >= 0 {
+		s.pendingMarker = ""
+	} else if bytes.ContainsAny(data, "\r\n") {
+		s.shellWrapper.PushInput([]byte(s.pendingMarker + "\r"))
+		s.pendingMarker = ""
+	}
+}
+
+func (s *Server) handleLLMInput(data []byte) {
+	Debug("Received LLM input: %d bytes", len(data))
+	s.llmWrapper.AddLLMInput(data)
 }
 
 func (s *Server) outputToShell(data []byte) {
-	s.lastShellLine = keepLastLine(s.lastLLMLine, data)
-	s.outputToConn(data, s.shellWriter)
+	s.clients.Output(messages.Role_SHELL, data)
 }
 
 func (s *Server) outputToLLM(data []byte) {
-	s.lastLLMLine = keepLastLine(s.lastLLMLine, data)
-	s.outputToConn(data, s.llmWriter)
+	s.clients.Output(messages.Role_LLM, data)
 }
 
 func getLastLine(data []byte) (int, []byte) {
@@ -272,13 +602,21 @@ func getLastLine(data []byte) (int, []byte) {
 	}
 }
 
+// output without newlines, e.g. a progress bar, would grow the last line
+// without bounds
+const MAX_LAST_LINE_BYTES = 4096
+
 func keepLastLine(lastLine []byte, data []byte) []byte {
 	n, last := getLastLine(data)
 	if n == 0 {
-		return slices.Concat(lastLine, data)
-	} else {
-		return last
+		last = slices.Concat(lastLine, data)
 	}
+
+	if len(last) > MAX_LAST_LINE_BYTES {
+		last = last[len(last)-MAX_LAST_LINE_BYTES:]
+	}
+
+	return last
 }
 
 func (s *Server) handleConnection(conn net.Conn) {
@@ -288,13 +626,17 @@ func (s *Server) handleConnection(conn net.Conn) {
 	var message messages.Message
 
 	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
 
 	Debug("Reading registration message from connection")
 
-	err := protodelim.UnmarshalFrom(reader, &message)
+	conn.SetReadDeadline(time.Now().Add(HEARTBEAT_TIMEOUT))
+
+	err := readMessage(reader, &message, MAX_MESSAGE_SIZE)
 
 	if err != nil {
-		Error("Error unmarshalling command: %v", err)
+		rejectClient(writer, messages.ErrorCode_ERROR_INVALID_REGISTRATION,
+			"invalid registration message: %v", err)
 		return
 	}
 
@@ -303,7 +645,13 @@ func (s *Server) handleConnection(conn net.Conn) {
 	registration := message.GetRegistration()
 
 	if registration == nil {
-		Error("Expected registration message, got %v", message.Type)
+		rejectClient(writer, messages.ErrorCode_ERROR_INVALID_REGISTRATION,
+			"expected a registration message, got %v", message.Type)
+		return
+	}
+
+	if err := checkProtocol(registration.ProtocolVersion); err != nil {
+		rejectClient(writer, messages.ErrorCode_ERROR_PROTOCOL_MISMATCH, "%v", err)
 		return
 	}
 
@@ -312,136 +660,153 @@ func (s *Server) handleConnection(conn net.Conn) {
 	role := registration.Role
 
 	if sessionId != s.sessionId {
-		Error("Session ID mismatch: expected %d, got %d",
-			s.sessionId, sessionId)
+		rejectClient(writer, messages.ErrorCode_ERROR_SESSION_MISMATCH,
+			"this server runs session %d, not %d", s.sessionId, sessionId)
 		return
 	}
 
-	Debug("Session ID: %d, Role: %v, size = %d x %d",
-		sessionId, role, registration.Width, registration.Height)
+	capabilities := negotiateCapabilities(registration.Capabilities)
 
-	var channel chan interface{}
+	maxMessageSize, err := negotiateMessageSize(registration.MaxMessageSize)
+	if err != nil {
+		rejectClient(writer, messages.ErrorCode_ERROR_INVALID_REGISTRATION, "%v", err)
+		return
+	}
 
-	writer := bufio.NewWriter(conn)
+	Debug("Session ID: %d, Role: %v, size = %d x %d, protocol %d, capabilities %v",
+		sessionId, role, registration.Width, registration.Height,
+		registration.ProtocolVersion, capabilities)
 
-	var lastLine []byte
-
-	if role == messages.Role_SHELL && s.shellSocket == nil {
-		defer func() {
-			s.shellSocket = nil
-			s.shellWriter = nil
-		}()
-
-		s.shellSocket = conn
-		s.shellWriter = writer
-		channel = s.shellChannel
-		lastLine = s.lastShellLine
-
-		s.shellWrapper.ResizeTerminal(registration.Width, registration.Height)
-	} else if role == messages.Role_LLM && s.llmSocket == nil {
-		defer func() {
-			s.llmSocket = nil
-			s.llmWriter = nil
-		}()
-
-		s.llmSocket = conn
-		s.llmWriter = writer
-		channel = s.llmChannel
-		lastLine = s.lastLLMLine
-	} else {
-		Error("Unknown role: %v", role)
+	pane := role
+
+	switch role {
+	case messages.Role_SHELL, messages.Role_LLM:
+	case messages.Role_OBSERVER:
+		pane = registration.Watch
+
+		if pane != messages.Role_SHELL && pane != messages.Role_LLM {
+			rejectClient(writer, messages.ErrorCode_ERROR_UNKNOWN_ROLE,
+				"observers watch the SHELL or the LLM pane, not %v", pane)
+			return
+		}
+	default:
+		rejectClient(writer, messages.ErrorCode_ERROR_UNKNOWN_ROLE, "unknown role %v", role)
 		return
 	}
 
+	client := &AttachedClient{
+		role:   role,
+		pane:   pane,
+		leader: registration.Leader,
+		conn:   conn,
+		writer: writer,
+
+		maxMessageSize: maxMessageSize,
+	}
+
 	response := &messages.Message{
 		Type: messages.MessageType_REGISTERED,
 		Message: &messages.Message_Registered{
 			Registered: &messages.RegisteredMessage{
-				MaxMessageSize: 1024,
+				MaxMessageSize:  maxMessageSize,
+				ProtocolVersion: registration.ProtocolVersion,
+				Capabilities:    capabilities,
 			},
 		},
 	}
 
-	_, err = protodelim.MarshalTo(writer, response)
-	if err != nil {
-		Error("Error marshalling response: %v", err)
-		return
-	}
+	reply := make(chan error, 1)
 
-	err = writer.Flush()
-	if err != nil {
-		Error("Error flushing data: %v", err)
-		return
+	attach := AttachEvent{
+		client:      client,
+		registered:  response,
+		resumeAfter: registration.ResumeAfter,
+		width:       registration.Width,
+		height:      registration.Height,
+		reply:       reply,
 	}
 
-	lastLineMessage := &messages.Message{
-		Type: messages.MessageType_OUTPUT,
-		Message: &messages.Message_Output{
-			Output: &messages.OutputMessage{
-				Data: lastLine,
-			},
-		},
-	}
-
-	_, err = protodelim.MarshalTo(writer, lastLineMessage)
-	if err != nil {
-		Error("Error marshalling last line message: %v", err)
+	if !s.post(attach) {
 		return
 	}
 
-	err = writer.Flush()
-	if err != nil {
-		Error("Error flushing data: %v", err)
+	// the loop always answers an attach it took
+	if err := <-reply; err != nil {
+		rejectClient(writer, messages.ErrorCode_ERROR_ROLE_TAKEN, "%v", err)
 		return
 	}
 
-	s.runConnection(reader, channel)
+	defer s.post(DetachEvent{client: client})
+
+	s.runConnection(reader, client)
 }
 
-func (s *Server) runConnection(reader *bufio.Reader, channel chan interface{}) {
+func (s *Server) runConnection(reader *bufio.Reader, client *AttachedClient) {
 	for {
 		message := &messages.Message{}
 
-		err := protodelim.UnmarshalFrom(reader, message)
+		// clients ping regularly, a silent one is gone
+		client.conn.SetReadDeadline(time.Now().Add(HEARTBEAT_TIMEOUT))
+
+		err := readMessage(reader, message, client.maxMessageSize)
 
 		if err != nil {
-			Error("Error unmarshalling message: %v", err)
+			Error("Error unmarshalling message from %v: %v", client, err)
 			return
 		}
 
-		userInput := message.GetUserInput()
-
-		if userInput != nil {
-			channel <- userInput.Data
+		var event ServerEvent
+
+		switch {
+		case message.GetPing() != nil:
+			event = PingEvent{client: client, ack: message.GetPing().Ack}
+		case message.GetUserInput() != nil:
+			event = InputEvent{client: client, data: message.GetUserInput().Data}
+		case message.GetSignal() != nil:
+			event = SignalEvent{client: client, signal: message.GetSignal().Signal}
+		case message.GetResize() != nil:
+			resize := message.GetResize()
+			event = ResizeEvent{client: client, width: resize.Width, height: resize.Height}
+		default:
+			Debug("Ignoring %v message from %v", message.Type, client)
+			continue
 		}
 
-		resize := message.GetResize()
-
-		if resize != nil {
-			channel <- Size{
-				Width:  resize.Width,
-				Height: resize.Height,
-			}
+		if !s.post(event) {
+			return
 		}
 	}
 }
 
 func (s *Server) Stop() {
 	Debug("Stopping server")
-	if s.shellSocket != nil {
-		s.shellSocket.Close()
-	}
 
-	if s.llmSocket != nil {
-		s.llmSocket.Close()
-	}
+	close(s.stopped)
+
+	// the usage summary goes out while the LLM client is still connected
+	summary := "Session usage:\n" + s.llmWrapper.usage.Describe()
+	Info("%s", summary)
+	s.outputToLLM([]byte(adjustNewlines(summary)))
 
+	// no reconnects from here on
 	if s.listenSocket != nil {
 		s.listenSocket.Close()
 	}
 
+	if s.exit != nil {
+		s.clients.Broadcast(exitMessage(*s.exit))
+	}
+
+	s.clients.CloseAll()
+
 	s.shellWrapper.Stop()
 	s.llmWrapper.Stop()
 
+	s.sandbox.Remove()
+
+	for root := range s.checkpointRoots {
+		RemoveSessionIndex(root, s.sessionId)
+	}
+
 	os.Remove(fmt.Sprintf("/tmp/lash-%d/default", s.sessionId))
 }
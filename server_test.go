@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/darfire/layosh/messages"
+)
+
+const TEST_SESSION_ID = 4242
+
+// well under HEARTBEAT_TIMEOUT, so that a lost message fails the test
+// instead of waiting for the server to hang up
+const TEST_READ_TIMEOUT = 5 * time.Second
+
+// newTestServer returns a server with its client side only: no shell, no
+// LLM and no listener. Clients connect with dialTestServer.
+func newTestServer() *Server {
+	events := make(chan ServerEvent, EVENT_QUEUE_SIZE)
+
+	return &Server{
+		sessionId: TEST_SESSION_ID,
+		clients:   NewClientRegistry(ResizeSmallest, events),
+		events:    events,
+		stopped:   make(chan struct{}),
+	}
+}
+
+// runTestLoop stands in for the server loop, writing what comes from output
+// to the shell pane, until stop is closed. The returned channel is closed
+// once the clients are gone.
+func runTestLoop(s *Server, output <-chan []byte, stop <-chan struct{}) <-chan struct{} {
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		for {
+			select {
+			case event := <-s.events:
+				s.handleEvent(event)
+			case data := <-output:
+				s.clients.Output(messages.Role_SHELL, data)
+			case <-stop:
+				close(s.stopped)
+				s.clients.CloseAll()
+				return
+			}
+		}
+	}()
+
+	return done
+}
+
+// dialTestServer registers a client over a pipe served by s. The returned
+// channel is closed when the server is done with the connection, its
+// detach posted.
+func dialTestServer(s *Server, role messages.Role, watch messages.Role) (net.Conn, *bufio.Reader, <-chan struct{}, error) {
+	conn, serverConn := net.Pipe()
+
+	served := make(chan struct{})
+
+	go func() {
+		defer close(served)
+		s.handleConnection(serverConn)
+	}()
+
+	registration := &messages.Message{
+		Type: messages.MessageType_REGISTRATION,
+		Message: &messages.Message_Registration{
+			Registration: &messages.RegistrationMessage{
+				SessionId:       TEST_SESSION_ID,
+				Role:            role,
+				Watch:           watch,
+				ProtocolVersion: PROTOCOL_VERSION,
+			},
+		},
+	}
+
+	reader := bufio.NewReader(conn)
+
+	if err := writeMessage(bufio.NewWriter(conn), registration); err != nil {
+		conn.Close()
+		return nil, nil, nil, err
+	}
+
+	var response messages.Message
+
+	if err := readMessage(reader, &response, MAX_MESSAGE_SIZE); err != nil {
+		conn.Close()
+		return nil, nil, nil, err
+	}
+
+	if response.GetRegistered() == nil {
+		conn.Close()
+		return nil, nil, nil, fmt.Errorf("expected REGISTERED, got %v: %v", response.Type, response.GetError())
+	}
+
+	return conn, reader, served, nil
+}
+
+// attachOnce reads a few outputs and a pong from a fresh client, checking
+// that the output comes in order, then hangs up.
+func attachOnce(s *Server, role messages.Role) error {
+	conn, reader, served, err := dialTestServer(s, role, messages.Role_SHELL)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		conn.Close()
+		<-served
+	}()
+
+	conn.SetReadDeadline(time.Now().Add(TEST_READ_TIMEOUT))
+
+	ping := &messages.Message{
+		Type:    messages.MessageType_PING,
+		Message: &messages.Message_Ping{Ping: &messages.PingMessage{}},
+	}
+
+	// writes to a pipe wait for the reader, and the server may be busy
+	// writing output to us
+	go writeMessage(bufio.NewWriter(conn), ping)
+
+	var lastSequence uint64
+	outputs := 0
+	pong := false
+
+	for outputs < 3 || !pong {
+		var message messages.Message
+
+		if err := readMessage(reader, &message, MAX_MESSAGE_SIZE); err != nil {
+			return err
+		}
+
+		switch {
+		case message.GetPong() != nil:
+			pong = true
+		case message.GetOutput() != nil:
+			outputs++
+
+			sequence := message.GetOutput().Sequence
+			if sequence == 0 {
+				continue
+			}
+
+			if sequence <= lastSequence {
+				return fmt.Errorf("output %d came after %d", sequence, lastSequence)
+			}
+
+			lastSequence = sequence
+		}
+	}
+
+	return nil
+}
+
+func TestConcurrentClients(t *testing.T) {
+	s := newTestServer()
+
+	output := make(chan []byte)
+	stop := make(chan struct{})
+
+	loopDone := runTestLoop(s, output, stop)
+
+	// the shell keeps printing while the clients come and go
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case output <- []byte(fmt.Sprintf("line %d\r\n", i)):
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+
+	for range MAX_CLIENTS_PER_ROLE {
+		for _, role := range []messages.Role{messages.Role_SHELL, messages.Role_OBSERVER} {
+			wg.Add(1)
+
+			go func() {
+				defer wg.Done()
+
+				for range 5 {
+					if err := attachOnce(s, role); err != nil {
+						t.Errorf("%v client: %v", role, err)
+						return
+					}
+				}
+			}()
+		}
+	}
+
+	wg.Wait()
+
+	close(stop)
+	<-loopDone
+
+	if n := len(s.clients.clients); n != 0 {
+		t.Errorf("%d clients still attached", n)
+	}
+}
+
+// A client that fell behind on output still gets its pong.
+func TestPongWhileBehind(t *testing.T) {
+	s := newTestServer()
+
+	output := make(chan []byte)
+	stop := make(chan struct{})
+
+	loopDone := runTestLoop(s, output, stop)
+
+	conn, reader, served, err := dialTestServer(s, messages.Role_SHELL, messages.Role_SHELL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		conn.Close()
+		close(stop)
+		<-loopDone
+		<-served
+	}()
+
+	// nothing reads yet, so the writer hangs on the pipe and the queue fills
+	for i := range 2 * CLIENT_QUEUE_SIZE {
+		output <- []byte(fmt.Sprintf("line %d\r\n", i))
+	}
+
+	ping := &messages.Message{
+		Type:    messages.MessageType_PING,
+		Message: &messages.Message_Ping{Ping: &messages.PingMessage{}},
+	}
+
+	go writeMessage(bufio.NewWriter(conn), ping)
+
+	conn.SetReadDeadline(time.Now().Add(TEST_READ_TIMEOUT))
+
+	for {
+		var message messages.Message
+
+		if err := readMessage(reader, &message, MAX_MESSAGE_SIZE); err != nil {
+			t.Fatalf("no pong: %v", err)
+		}
+
+		if message.GetPong() != nil {
+			return
+		}
+	}
+}
+
+func TestAttachOverLimit(t *testing.T) {
+	s := newTestServer()
+
+	stop := make(chan struct{})
+	loopDone := runTestLoop(s, nil, stop)
+
+	defer func() {
+		close(stop)
+		<-loopDone
+	}()
+
+	for range MAX_CLIENTS_PER_ROLE {
+		conn, _, _, err := dialTestServer(s, messages.Role_SHELL, messages.Role_SHELL)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer conn.Close()
+	}
+
+	if conn, _, _, err := dialTestServer(s, messages.Role_SHELL, messages.Role_SHELL); err == nil {
+		conn.Close()
+		t.Fatalf("attached more than %d shell clients", MAX_CLIENTS_PER_ROLE)
+	}
+}
@@ -2,20 +2,68 @@ package main
 
 import (
 	"fmt"
+	"maps"
+	"slices"
 	"strconv"
+	"strings"
 )
 
 type Settings struct {
-	debug   bool
-	review  bool
-	verbose bool
+	debug    bool
+	review   bool
+	verbose  bool
+	sanitize SanitizePolicy
+
+	// hold file-modifying suggestions until /preview or /run
+	preview bool
+
+	// snapshot git working trees before running suggestions, for /undo
+	checkpoint bool
+
+	// step budget for /do
+	steps int
+
+	// how many ranked suggestions to ask for
+	alternatives int
+
+	// tools the model may call to inspect the environment
+	tools []string
+
+	// ground suggestions in local man pages and check their flags
+	docs bool
+
+	// seconds to wait for the model before answering offline
+	timeout int
+
+	generation GenerationConfig
+
+	// USD per million tokens, by provider/model or provider/*
+	prices map[string]ModelPrice
+
+	// session budgets, 0 for none
+	budgetTokens int
+	budgetCost   float64
+	budgetAction BudgetAction
 }
 
 func NewSettings() *Settings {
 	return &Settings{
-		debug:   false,
-		review:  false,
-		verbose: false,
+		debug:    false,
+		review:   false,
+		verbose:  false,
+		sanitize: SanitizeStrip,
+		preview:  true,
+
+		checkpoint: true,
+		steps:      10,
+
+		alternatives: 1,
+		tools:        slices.Clone(allTools),
+		docs:         true,
+		timeout:      60,
+
+		prices:       maps.Clone(defaultPrices),
+		budgetAction: BudgetWarn,
 	}
 }
 
@@ -38,8 +86,88 @@ func (s *Settings) UpdateFromString(key string, value string) error {
 		if err != nil {
 			return fmt.Errorf("invalid value for verbose: %s", value)
 		}
+	case "preview":
+		preview, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid value for preview: %s", value)
+		}
+		s.preview = preview
+	case "checkpoint":
+		checkpoint, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid value for checkpoint: %s", value)
+		}
+		s.checkpoint = checkpoint
+	case "steps":
+		steps, err := strconv.Atoi(value)
+		if err != nil || steps <= 0 {
+			return fmt.Errorf("invalid value for steps: %s", value)
+		}
+		s.steps = steps
+	case "alternatives":
+		alternatives, err := strconv.Atoi(value)
+		if err != nil || alternatives < 1 || alternatives > MAX_ALTERNATIVES {
+			return fmt.Errorf("invalid value for alternatives: %s", value)
+		}
+		s.alternatives = alternatives
+	case "tools":
+		tools, err := parseTools(value)
+		if err != nil {
+			return fmt.Errorf("invalid value for tools: %v", err)
+		}
+		s.tools = tools
+	case "timeout":
+		timeout, err := strconv.Atoi(value)
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("invalid value for timeout: %s", value)
+		}
+		s.timeout = timeout
+	case "docs":
+		docs, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid value for docs: %s", value)
+		}
+		s.docs = docs
+	case "price":
+		model, price, err := parsePrice(value)
+		if err != nil {
+			return fmt.Errorf("invalid value for price: %v", err)
+		}
+		s.prices[model] = price
+	case "budget_tokens":
+		budgetTokens, err := strconv.Atoi(value)
+		if err != nil || budgetTokens < 0 {
+			return fmt.Errorf("invalid value for budget_tokens: %s", value)
+		}
+		s.budgetTokens = budgetTokens
+	case "budget_cost":
+		budgetCost, err := strconv.ParseFloat(value, 64)
+		if err != nil || budgetCost < 0 {
+			return fmt.Errorf("invalid value for budget_cost: %s", value)
+		}
+		s.budgetCost = budgetCost
+	case "budget_action":
+		if value != string(BudgetWarn) && value != string(BudgetRefuse) {
+			return fmt.Errorf("invalid value for budget_action: %s", value)
+		}
+		s.budgetAction = BudgetAction(value)
+	case "sanitize":
+		sanitize, err := ParseSanitizePolicy(value)
+		if err != nil {
+			return fmt.Errorf("invalid value for sanitize: %s", value)
+		}
+		s.sanitize = sanitize
 	default:
-		return fmt.Errorf("unknown setting: %s", key)
+		if !slices.Contains(generationKeys, key) {
+			return fmt.Errorf("unknown setting: %s", key)
+		}
+
+		// on a copy, a bad value leaves the old one
+		generation := s.generation
+		if err := generation.update(key, value); err != nil {
+			return err
+		}
+		s.generation = generation
 	}
 
 	return nil
@@ -50,5 +178,42 @@ func (s *Settings) Describe() string {
 debug: %v
 review: %v
 verbose: %v
-`, s.debug, s.review, s.verbose)
+sanitize: %v
+preview: %v
+checkpoint: %v
+steps: %v
+alternatives: %v
+tools: %v
+docs: %v
+timeout: %v
+generation: %v
+budget: %v
+`, s.debug, s.review, s.verbose, s.sanitize, s.preview, s.checkpoint, s.steps, s.alternatives, s.describeTools(), s.docs, s.timeout,
+		s.generation.describe(), s.describeBudget())
+}
+
+func (s *Settings) describeTools() string {
+	if len(s.tools) == 0 {
+		return "none"
+	}
+
+	return strings.Join(s.tools, ",")
+}
+
+func (s *Settings) describeBudget() string {
+	var parts []string
+
+	if s.budgetTokens > 0 {
+		parts = append(parts, fmt.Sprintf("%d tokens", s.budgetTokens))
+	}
+
+	if s.budgetCost > 0 {
+		parts = append(parts, fmt.Sprintf("$%.4f", s.budgetCost))
+	}
+
+	if len(parts) == 0 {
+		return "none"
+	}
+
+	return fmt.Sprintf("%s (%s)", strings.Join(parts, ", "), s.budgetAction)
 }
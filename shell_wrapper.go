@@ -1,11 +1,15 @@
 package main
 
 import (
+	"fmt"
 	"os"
 	"os/exec"
+	"strconv"
 	"syscall"
+	"time"
 
 	pty "github.com/creack/pty"
+	"golang.org/x/sys/unix"
 )
 
 type ShellWrapper struct {
@@ -18,12 +22,33 @@ type ShellWrapper struct {
 	// we get notified when to quit
 	quitChannel chan bool
 	pty         *os.File
+
+	// optional, runs the command in a namespace sandbox
+	sandbox *Sandbox
+
+	// closed once the command exited
+	exited chan struct{}
 }
 
 type ShellExit struct {
+	// -1 when a signal killed the command
 	ExitCode int
+	Signal   syscall.Signal
+}
+
+func (e ShellExit) String() string {
+	if e.Signal != 0 {
+		return fmt.Sprintf("killed by %s", unix.SignalName(e.Signal))
+	}
+
+	return fmt.Sprintf("exited with code %d", e.ExitCode)
 }
 
+const SHELL_DRAIN_TIMEOUT = 200 * time.Millisecond
+
+// how long Stop waits for the killed command to go away
+const SHELL_STOP_TIMEOUT = 2 * time.Second
+
 func NewShellWrapper(command []string) *ShellWrapper {
 	return &ShellWrapper{
 		command:       command,
@@ -37,14 +62,25 @@ func (s *ShellWrapper) Start() error {
 	// This is a placeholder implementation
 	c := exec.Command(s.command[0], s.command[1:]...)
 
-	s.cmd = c
-
 	attrs := syscall.SysProcAttr{
 		// Setpgid: true,
 		Setsid:  true,
 		Setctty: true,
 	}
 
+	if s.sandbox != nil {
+		var err error
+
+		c, err = s.sandbox.Command(s.command)
+		if err != nil {
+			return err
+		}
+
+		s.sandbox.ApplyAttrs(&attrs)
+	}
+
+	s.cmd = c
+
 	f, err := pty.StartWithAttrs(c, nil, &attrs)
 
 	s.pty = f
@@ -54,8 +90,13 @@ func (s *ShellWrapper) Start() error {
 	}
 
 	stdoutChannel := make(chan []byte)
+	exitChannel := make(chan ShellExit, 1)
+
+	s.exited = make(chan struct{})
 
 	go func() {
+		defer close(stdoutChannel)
+
 		for {
 			buf := make([]byte, 1024)
 
@@ -65,31 +106,67 @@ func (s *ShellWrapper) Start() error {
 				break
 			}
 
-			stdoutChannel <- buf[:n]
+			select {
+			case stdoutChannel <- buf[:n]:
+			case <-s.quitChannel:
+				return
+			}
 		}
 	}()
 
 	go func() {
+		defer close(s.exited)
+
 		err := c.Wait()
 
 		if err != nil {
 			Error("Error waiting for command: %v", err)
 		}
 
-		Debug("Command exited with code: %d", c.ProcessState.ExitCode())
-
-		s.outputChannel <- ShellExit{
+		exit := ShellExit{
 			ExitCode: c.ProcessState.ExitCode(),
 		}
+
+		if status, ok := c.ProcessState.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			exit.Signal = status.Signal()
+		}
+
+		Debug("Command %v", exit)
+
+		exitChannel <- exit
 	}()
 
 	go func() {
 		defer c.Process.Kill()
 
+		var exit *ShellExit
+
+		// after the command exits, give the pty a moment to flush whatever
+		// output is still buffered, background jobs may keep it open
+		var drainTimeout <-chan time.Time
+
 		for {
 			select {
-			case data := <-stdoutChannel:
-				s.outputChannel <- data
+			case data, more := <-stdoutChannel:
+				if !more {
+					stdoutChannel = nil
+					if exit != nil {
+						s.send(*exit)
+						return
+					}
+					continue
+				}
+				s.send(data)
+			case e := <-exitChannel:
+				exit = &e
+				if stdoutChannel == nil {
+					s.send(e)
+					return
+				}
+				drainTimeout = time.After(SHELL_DRAIN_TIMEOUT)
+			case <-drainTimeout:
+				s.send(*exit)
+				return
 			case <-s.quitChannel:
 				return
 			}
@@ -99,8 +176,67 @@ func (s *ShellWrapper) Start() error {
 	return nil
 }
 
+// send forwards msg to the output channel, unless we're asked to quit.
+func (s *ShellWrapper) send(msg interface{}) {
+	select {
+	case s.outputChannel <- msg:
+	case <-s.quitChannel:
+	}
+}
+
+// Stop kills the command and whatever it left in its session, e.g.
+// background jobs, and waits for the command to exit. In a sandbox, that
+// takes the overlay mount down with the mount namespace.
 func (s *ShellWrapper) Stop() {
 	close(s.quitChannel)
+
+	if s.pty != nil {
+		s.pty.Close()
+	}
+
+	if s.cmd == nil || s.cmd.Process == nil || s.exited == nil {
+		return
+	}
+
+	s.cmd.Process.Kill()
+
+	// the command is the session leader
+	killSession(s.cmd.Process.Pid)
+
+	select {
+	case <-s.exited:
+	case <-time.After(SHELL_STOP_TIMEOUT):
+		Warn("The command didn't exit in %v", SHELL_STOP_TIMEOUT)
+	}
+}
+
+// killSession kills the processes of session sid. Processes that started
+// sessions of their own, like daemons, aren't found.
+func killSession(sid int) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		if session, err := unix.Getsid(pid); err == nil && session == sid {
+			syscall.Kill(pid, syscall.SIGKILL)
+		}
+	}
+}
+
+// WorkingDir returns the current directory of the wrapped command.
+func (s *ShellWrapper) WorkingDir() (string, error) {
+	if s.cmd == nil || s.cmd.Process == nil {
+		return "", fmt.Errorf("shell not started")
+	}
+
+	return os.Readlink(fmt.Sprintf("/proc/%d/cwd", s.cmd.Process.Pid))
 }
 
 func (s *ShellWrapper) PushInput(input []byte) {
@@ -109,6 +245,37 @@ func (s *ShellWrapper) PushInput(input []byte) {
 	}
 }
 
+// Signal sends sig to the foreground process group of the pty, the way the
+// terminal driver does for Ctrl-C.
+func (s *ShellWrapper) Signal(sig syscall.Signal) error {
+	if s.pty == nil {
+		return fmt.Errorf("shell not started")
+	}
+
+	conn, err := s.pty.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var pgrp int
+	var ioctlErr error
+
+	// Fd() would switch the pty to blocking mode under the reader
+	err = conn.Control(func(fd uintptr) {
+		pgrp, ioctlErr = unix.IoctlGetInt(int(fd), unix.TIOCGPGRP)
+	})
+
+	if err == nil {
+		err = ioctlErr
+	}
+
+	if err != nil {
+		return fmt.Errorf("error getting the foreground process group: %v", err)
+	}
+
+	return syscall.Kill(-pgrp, sig)
+}
+
 func (s *ShellWrapper) ResizeTerminal(width, height uint32) {
 	Debug("Resizing terminal to %d x %d\n", width, height)
 
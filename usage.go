@@ -0,0 +1,315 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/firebase/genkit/go/ai"
+)
+
+// a rough average for English text and code, for providers that don't
+// report token counts
+const CHARS_PER_TOKEN = 4
+
+// ModelPrice is what a model costs, in USD per million tokens.
+type ModelPrice struct {
+	input  float64
+	output float64
+}
+
+// list prices at the time of writing, override them with /set price
+var defaultPrices = map[string]ModelPrice{
+	"googleai/gemini-2.0-flash":      {input: 0.10, output: 0.40},
+	"googleai/gemini-2.0-flash-lite": {input: 0.075, output: 0.30},
+	"openai/gpt-4o-mini":             {input: 0.15, output: 0.60},
+	"openai/gpt-4o":                  {input: 2.50, output: 10.00},
+
+	// local models cost nothing per token
+	"ollama/*": {},
+}
+
+type BudgetAction string
+
+const (
+	BudgetWarn   BudgetAction = "warn"
+	BudgetRefuse BudgetAction = "refuse"
+)
+
+type UsageCommand struct{}
+
+func (c UsageCommand) String() string {
+	return "UsageCommand"
+}
+
+// UsageRecord is one call to a model.
+type UsageRecord struct {
+	model string
+
+	inputTokens  int
+	outputTokens int
+
+	// the provider didn't report the token counts
+	estimated bool
+
+	latency time.Duration
+
+	cost float64
+
+	// false when we don't know the model's price
+	priced bool
+}
+
+// UsageTracker records the model calls of a session. The server reads it
+// when the session ends, so it's locked.
+type UsageTracker struct {
+	mu sync.Mutex
+
+	records []UsageRecord
+
+	// the budget warning was shown
+	warned bool
+}
+
+func NewUsageTracker() *UsageTracker {
+	return &UsageTracker{}
+}
+
+// UsageTotals sums up usage records.
+type UsageTotals struct {
+	requests int
+
+	inputTokens  int
+	outputTokens int
+
+	latency time.Duration
+	cost    float64
+
+	estimated bool
+	unpriced  bool
+}
+
+func (t *UsageTotals) add(record UsageRecord) {
+	t.requests++
+	t.inputTokens += record.inputTokens
+	t.outputTokens += record.outputTokens
+	t.latency += record.latency
+	t.cost += record.cost
+	t.estimated = t.estimated || record.estimated
+	t.unpriced = t.unpriced || !record.priced
+}
+
+func (t *UsageTotals) describe() string {
+	approximate := ""
+	if t.estimated {
+		approximate = "~"
+	}
+
+	cost := fmt.Sprintf("$%.4f", t.cost)
+	if t.unpriced {
+		cost += " (some models have no price)"
+	}
+
+	average := time.Duration(0)
+	if t.requests > 0 {
+		average = t.latency / time.Duration(t.requests)
+	}
+
+	return fmt.Sprintf("%d requests, %s%d input and %s%d output tokens, %s, %v average latency",
+		t.requests, approximate, t.inputTokens, approximate, t.outputTokens, cost,
+		average.Round(time.Millisecond))
+}
+
+func (u *UsageTracker) Record(record UsageRecord) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.records = append(u.records, record)
+}
+
+// warnOnce returns true the first time it's called, so the budget warning
+// is shown once per session.
+func (u *UsageTracker) warnOnce() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.warned {
+		return false
+	}
+
+	u.warned = true
+	return true
+}
+
+func (u *UsageTracker) Totals() UsageTotals {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	var totals UsageTotals
+
+	for _, record := range u.records {
+		totals.add(record)
+	}
+
+	return totals
+}
+
+// Describe returns the totals, per model and for the session.
+func (u *UsageTracker) Describe() string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if len(u.records) == 0 {
+		return "No model requests yet\n"
+	}
+
+	perModel := map[string]*UsageTotals{}
+	var total UsageTotals
+
+	for _, record := range u.records {
+		if perModel[record.model] == nil {
+			perModel[record.model] = &UsageTotals{}
+		}
+
+		perModel[record.model].add(record)
+		total.add(record)
+	}
+
+	var models []string
+	for model := range perModel {
+		models = append(models, model)
+	}
+	sort.Strings(models)
+
+	var out strings.Builder
+
+	for _, model := range models {
+		fmt.Fprintf(&out, "%s: %s\n", model, perModel[model].describe())
+	}
+
+	fmt.Fprintf(&out, "Session: %s\n", total.describe())
+
+	if total.estimated {
+		out.WriteString("(~ token counts are estimated, the provider didn't report them)\n")
+	}
+
+	return out.String()
+}
+
+func estimateTokens(text string) int {
+	return (len(text) + CHARS_PER_TOKEN - 1) / CHARS_PER_TOKEN
+}
+
+// requestText returns the text sent in a model request.
+func requestText(request *ai.ModelRequest) string {
+	var out strings.Builder
+
+	for _, message := range request.Messages {
+		out.WriteString(message.Text())
+	}
+
+	return out.String()
+}
+
+// priceOf looks up the price of model, then of its provider's wildcard.
+func (s *Settings) priceOf(model string) (ModelPrice, bool) {
+	provider, _, _ := strings.Cut(model, "/")
+
+	for _, name := range []string{model, provider + "/*"} {
+		if price, ok := s.prices[name]; ok {
+			return price, true
+		}
+	}
+
+	return ModelPrice{}, false
+}
+
+// parsePrice reads "<provider/model> <input> <output>", in USD per million
+// tokens.
+func parsePrice(value string) (string, ModelPrice, error) {
+	fields := strings.Fields(value)
+	if len(fields) != 3 || !strings.Contains(fields[0], "/") {
+		return "", ModelPrice{}, fmt.Errorf("expected <provider/model> <input price> <output price>")
+	}
+
+	input, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil || input < 0 {
+		return "", ModelPrice{}, fmt.Errorf("invalid input price: %s", fields[1])
+	}
+
+	output, err := strconv.ParseFloat(fields[2], 64)
+	if err != nil || output < 0 {
+		return "", ModelPrice{}, fmt.Errorf("invalid output price: %s", fields[2])
+	}
+
+	return fields[0], ModelPrice{input: input, output: output}, nil
+}
+
+// recordUsage adds a model call to the session's usage, estimating the token
+// counts when the provider doesn't report them.
+func (l *LLMWrapper) recordUsage(model *ChainModel, response *ai.ModelResponse, latency time.Duration) {
+	record := UsageRecord{
+		model:   model.Name(),
+		latency: latency,
+	}
+
+	if response.Usage != nil && (response.Usage.InputTokens > 0 || response.Usage.OutputTokens > 0) {
+		record.inputTokens = response.Usage.InputTokens
+		record.outputTokens = response.Usage.OutputTokens
+	} else {
+		record.estimated = true
+		record.outputTokens = estimateTokens(response.Text())
+
+		if response.Request != nil {
+			record.inputTokens = estimateTokens(requestText(response.Request))
+		}
+	}
+
+	price, ok := l.settings.priceOf(record.model)
+
+	record.priced = ok
+	record.cost = (float64(record.inputTokens)*price.input + float64(record.outputTokens)*price.output) / 1e6
+
+	l.usage.Record(record)
+
+	if err := l.overBudget(); err != nil && l.settings.budgetAction == BudgetWarn && l.usage.warnOnce() {
+		l.outputToWarning(err.Error())
+	}
+}
+
+// overBudget returns an error once the session went over one of its budgets.
+func (l *LLMWrapper) overBudget() error {
+	totals := l.usage.Totals()
+
+	if l.settings.budgetTokens > 0 && totals.inputTokens+totals.outputTokens >= l.settings.budgetTokens {
+		return fmt.Errorf("the session used %d tokens, its budget is %d",
+			totals.inputTokens+totals.outputTokens, l.settings.budgetTokens)
+	}
+
+	if l.settings.budgetCost > 0 && totals.cost >= l.settings.budgetCost {
+		return fmt.Errorf("the session cost $%.4f, its budget is $%.4f",
+			totals.cost, l.settings.budgetCost)
+	}
+
+	return nil
+}
+
+// refuseOverBudget tells whether a new request has to be refused.
+func (l *LLMWrapper) refuseOverBudget() bool {
+	if l.settings.budgetAction != BudgetRefuse {
+		return false
+	}
+
+	err := l.overBudget()
+	if err == nil {
+		return false
+	}
+
+	l.outputToTerminal(adjustNewlines(fmt.Sprintf(
+		"Request refused: %v\nRaise it with /set budget_tokens or /set budget_cost\n", err)))
+
+	return true
+}